@@ -1,27 +1,148 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"imagebatcher/registry"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 import "github.com/docopt/docopt-go"
 
 var usage = `image-batch
 Usage:
-  image-batch dump -f <filename> <tarfile>  
-  image-batch load <tarfile>              
+  image-batch dump [--daemon] [--runtime <runtime>] [--namespace <namespace>] [--auth-file <authfile>] [--workdir <workdir>] [--format <format>] [--platform <platform>] [--base <basefile>] [--group <group>...] [--fail-fast | --keep-going] [--retries <retries>] [--retry-delay <delay>] [--retry-max-delay <delay>] [--retry-jitter <jitter>] (--lock <lockfile> | [-f <filename>] [--from-k8s <path>]... [--from-compose <composefile>]... [--env-file <envfile>] [--from-local <filter>]...) <tarfile>
+  image-batch load [--runtime <runtime>] [--namespace <namespace>] [--workdir <workdir>] [--platform <platform>] [--base <basefile>] [--keep-data] [--fail-fast | --keep-going] [--retries <retries>] [--retry-delay <delay>] [--retry-max-delay <delay>] [--retry-jitter <jitter>] [--to <target>] [--insecure] [--auth-file <authfile>] [--username <username>] [--password <password> | --password-stdin] <tarfile>
+  image-batch verify <tarfile>
+  image-batch (inspect | ls) [--output <output>] <tarfile>
+  image-batch cleanup [--runtime <runtime>] [--namespace <namespace>] [--workdir <workdir>] [--dry-run]
+
+Options:
+  -f <filename>       image list, one image per line, or a structured yaml or json list
+  --daemon            pull images through a container runtime instead of the native registry client
+  --runtime <runtime>  container runtime, docker, podman, nerdctl, ctr or auto [default: auto]
+  --namespace <namespace>  containerd namespace of nerdctl and ctr, such as k8s.io
+  --auth-file <authfile>  registry credentials in the format of docker's config.json, auths, credHelpers and
+                      credsStore are read. default to $DOCKER_CONFIG/config.json or ~/.docker/config.json
+  --workdir <workdir>  dir each run stages its files in, under a unique dir of its own, and load --keep-data
+                      keeps the registry data in. default to the temp dir, such as /tmp
+  --format <format>   archive format, registry or oci [default: registry]
+  --platform <platform>  dump: platforms kept out of manifest lists, such as linux/amd64,linux/arm64, or all.
+                      the manifest list is kept along with them. default to the host platform only.
+                      load: platform pulled out of manifest lists instead of the host platform
+  --base <basefile>   dump: leave out the blobs carried by this previous archive.
+                      load: extract this archive before the delta archive
+  --group <group>     dump the images of this group of a structured image list only, repeatable
+  --from-k8s <path>   dump the images of the workloads in the kubernetes manifests of this file or directory,
+                      such as the output of helm template. repeatable, along with -f or not
+  --from-compose <composefile>  dump the images of the services of this docker-compose file, repeatable
+  --env-file <envfile>  env file interpolating the compose files, default to the .env next to each of them
+  --from-local <filter>  with --daemon, dump the images of the local image store matching this filter, such as
+                      reference=myapp/* or label=release=2.3, without pulling them. repeatable
+  --lock <lockfile>   dump the images of a lockfile written by a previous dump, pinned to their manifest digests
+  --fail-fast         stop once an image failed to be fetched, pulled, retagged or pushed, the others are skipped
+  --keep-going        go through every image whatever the others become, the default
+  --retries <retries>  retries of a fetch, copy, or pull, retag or push of the container runtime failing transiently,
+                      0 never retries. default to 3. errors such as manifest unknown or unauthorized are not retried
+  --retry-delay <delay>  delay before the first retry, doubled for each of the next ones, such as 500ms. default to 2s
+  --retry-max-delay <delay>  longest delay between two retries. default to 1m
+  --retry-jitter <jitter>  fraction of the delay it's spread by, 0 to 1. default to 0.2
+  --keep-data         keep the extracted registry data in the work dir, so later delta archives loaded with
+                      the same --workdir go on top of it
+  --to <target>       push the images into the registry registry.internal:5000[/prefix] instead of the container runtime
+  --insecure          allow plain http and skip tls verification of the target registry
+  --username <username>  username of the target registry, basic or token auth
+  --password <password>  password of the target registry, shown by ps and kept in the shell history. prefer the
+                      auth file, --password-stdin or $IMAGE_BATCH_PASSWORD
+  --password-stdin    read the password of the target registry from stdin
+  --output <output>   output format of inspect, table or json [default: table]
+  --dry-run           report what crashed runs left behind without removing it
 `
 
+var (
+	// output formats of inspect
+	OUTPUT_TABLE="table"
+	OUTPUT_JSON="json"
+
+	// PASSWORD_ENV is the password of the target registry of load --to when neither --password nor --password-stdin is given
+	PASSWORD_ENV="IMAGE_BATCH_PASSWORD"
+)
+
+// Options is the settings of dump and load parsed from the command line
 type Options struct {
+	// Daemon pull images through the container runtime instead of the native registry client
+	Daemon bool
+
+	// Runtime is the container runtime images are pulled, tagged and pushed through
+	Runtime registry.Runtime
+
+	// Format of the dumped archive
+	Format string
+
+	// Base is the previous archive of an incremental dump, or the base of a delta archive to load
+	Base string
+
+	// KeepData keep the registry data extracted by load
+	KeepData bool
+
+	// Target is the registry load pushes images into, instead of the container runtime
+	Target string
+
+	// TargetClient talks to Target
+	TargetClient *registry.Client
+
+	// Platforms are kept by dump, or pulled by load
+	Platforms []registry.Platform
+
+	// AllPlatforms keep every platform of manifest lists on dump
+	AllPlatforms bool
 
+	// Lock is the lockfile dump pins the images to, instead of an image list
+	Lock string
+
+	// Groups of a structured image list to dump, all images if empty
+	Groups []string
+
+	// FromK8s are kubernetes manifests, files or directories, whose images are dumped along with the image list
+	FromK8s []string
+
+	// FromCompose are docker-compose files whose images are dumped along with the image list
+	FromCompose []string
+
+	// EnvFile interpolates FromCompose, instead of the .env next to each of them
+	EnvFile string
+
+	// FromLocal are the filters of the images of the local image store dumped without pulling them
+	FromLocal []string
+
+	// AuthFile holds the registry credentials, empty for the default one
+	AuthFile string
+
+	// Credentials of the remote registries, read from AuthFile
+	Credentials registry.CredentialFunc
+
+	// FailFast stop once an image failed instead of going through every image
+	FailFast bool
+
+	// WorkDir is the dir the files are staged in, the temp dir if empty
+	WorkDir string
+
+	// Retry is how the fetches, copies, and the pulls, retags and pushes of the container runtime failing transiently are retried
+	Retry registry.RetryPolicy
 }
 
 func checkFileValid(opts docopt.Opts) bool{
 	// check that the filename is not empty
-	filename:=opts["<filename>"].(string)
+	filename,_:=opts["-f"].(string)
 	if strings.TrimSpace(filename) == "" {
 		return false
 	}
@@ -32,27 +153,51 @@ func checkFileValid(opts docopt.Opts) bool{
 func Parse() {
 	opts, _ := docopt.ParseArgs(usage,os.Args[1:],"v1.0")
 
-	modified,err := registry.ConfirmDaemonJson()
+	// the pulls and pushes in flight are canceled on SIGINT or SIGTERM, and what dump or load left behind is cleaned up
+	ctx,stop:=interruptContext()
+	defer stop()
+
+	options,err:=parseOptions(opts)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	if modified{
-		fmt.Println("please restart the docker daemon,using `systemctl restart docker` to make modified content in `/etc/docker/daemon.json` take effect")
-		return
-	}
 
 	// parse dump
 	isDump:=opts["dump"].(bool)
 	if isDump {
+		options.Credentials=credentials(options.AuthFile)
+		// the copy of the auth file made for the runtime is removed before exiting, failed or not
+		release:=func(){}
+		if options.Daemon {
+			options.Runtime=runtime(opts)
+			if options.AuthFile != "" {
+				rt,releaseAuth,err:=options.Runtime.WithAuthFile(options.AuthFile)
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+				options.Runtime,release=rt,releaseAuth
+			}
+			if len(options.Platforms) == 1 {
+				options.Runtime=options.Runtime.ForPlatform(options.Platforms[0].String())
+			}
+			if !options.Runtime.CanRun() {
+				release()
+				log.Fatalf("runtime %s can't run the registry container, dump without --daemon instead",options.Runtime.Name())
+			}
+		}
 
 		tarfile:=strings.TrimSpace(opts["<tarfile>"].(string))
 		if tarfile == ""{
+			release()
 			log.Fatal("tarfile can't be empty")
 		}
-		if !checkFileValid(opts){
+		if options.Lock == "" && len(options.FromK8s) == 0 && len(options.FromCompose) == 0 && len(options.FromLocal) == 0 && !checkFileValid(opts){
+			release()
 			log.Fatal("filename can't be empty")
 		}
-		err:=BatchDump(opts["<filename>"].(string),tarfile)
+		filename,_:=opts["-f"].(string)
+		err:=BatchDump(ctx,filename,tarfile,options)
+		release()
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -65,48 +210,422 @@ func Parse() {
 		if tarfile == ""{
 			log.Fatal("tarfile can't be empty")
 		}
-		err:=BatchLoad(tarfile)
+		if strings.TrimSpace(options.Target) != "" {
+			options.Credentials=credentials(options.AuthFile)
+			client,err:=targetClient(opts,options.Credentials)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			options.TargetClient=client
+		}else{
+			options.Runtime=runtime(opts)
+		}
+		err:=BatchLoad(ctx,tarfile,options)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+	// parse verify
+	isVerify:=opts["verify"].(bool)
+	if isVerify{
+		tarfile:=strings.TrimSpace(opts["<tarfile>"].(string))
+		if tarfile == ""{
+			log.Fatal("tarfile can't be empty")
+		}
+		err:=BatchVerify(tarfile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+	// parse inspect
+	isInspect:=opts["inspect"].(bool) || opts["ls"].(bool)
+	if isInspect{
+		tarfile:=strings.TrimSpace(opts["<tarfile>"].(string))
+		if tarfile == ""{
+			log.Fatal("tarfile can't be empty")
+		}
+		err:=BatchInspect(tarfile,strings.TrimSpace(opts["--output"].(string)))
 		if err != nil {
 			log.Fatal(err.Error())
 		}
+		return
+	}
+	// parse cleanup
+	isCleanup:=opts["cleanup"].(bool)
+	if isCleanup{
+		name,_:=opts["--runtime"].(string)
+		namespace,_:=opts["--namespace"].(string)
+		// the files are cleaned up even if no runtime is found
+		rt,err:=registry.NewRuntime(name,namespace)
+		if err != nil {
+			log.Printf("%s, containers are not looked for \n",err.Error())
+			rt=nil
+		}
+		err=BatchCleanup(ctx,rt,options.WorkDir,opts["--dry-run"].(bool))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+
+}
+
+// interruptContext return a context canceled by the first SIGINT or SIGTERM, the second one exits at once.
+// stop releases the signals
+func interruptContext() (context.Context,func()){
+	ctx,cancel:=context.WithCancel(context.Background())
+	signals:=make(chan os.Signal,2)
+	signal.Notify(signals,os.Interrupt,syscall.SIGTERM)
+	go func(){
+		select {
+		case sig:=<-signals:
+			log.Printf("received %s, canceling and cleaning up, send it again to exit at once \n",sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		sig:=<-signals
+		log.Printf("received %s again, exit without cleaning up \n",sig)
+		os.Exit(130)
+	}()
+	return ctx,func(){
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// runtime return the container runtime chosen by --runtime and --namespace
+func runtime(opts docopt.Opts) registry.Runtime{
+	name,_:=opts["--runtime"].(string)
+	namespace,_:=opts["--namespace"].(string)
+	rt,err:=registry.NewRuntime(name,namespace)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("using container runtime %s \n",rt.Name())
+	return rt
+}
+
+// parseOptions map the options of dump and load, and of the other commands taking some of them, into Options.
+// the runtime and the credentials are left to the caller
+func parseOptions(opts docopt.Opts) (Options,error){
+	var err error
+	options:=Options{}
+	options.Base,_=opts["--base"].(string)
+	options.AuthFile,_=opts["--auth-file"].(string)
+	options.FailFast=failFast(opts)
+	options.WorkDir,_=opts["--workdir"].(string)
+	options.Retry,err=retry(opts)
+	if err != nil {
+		return options,err
+	}
+	options.Platforms,options.AllPlatforms,err=platforms(opts)
+	if err != nil {
+		return options,err
+	}
+
+	if dump,_:=opts["dump"].(bool);dump {
+		options.Daemon,_=opts["--daemon"].(bool)
+		format,_:=opts["--format"].(string)
+		options.Format=strings.TrimSpace(format)
+		if options.Format != registry.FORMAT_REGISTRY && options.Format != registry.FORMAT_OCI {
+			return options,fmt.Errorf("unknown format %s, must be %s or %s",options.Format,registry.FORMAT_REGISTRY,registry.FORMAT_OCI)
+		}
+		if options.Daemon && options.Format == registry.FORMAT_OCI {
+			return options,fmt.Errorf("format %s can't be used with --daemon",options.Format)
+		}
+		options.Lock,_=opts["--lock"].(string)
+		options.Groups,_=opts["--group"].([]string)
+		options.FromK8s,_=opts["--from-k8s"].([]string)
+		options.FromCompose,_=opts["--from-compose"].([]string)
+		options.EnvFile,_=opts["--env-file"].(string)
+		options.FromLocal,_=opts["--from-local"].([]string)
+		if !options.Daemon && len(options.FromLocal) != 0 {
+			return options,fmt.Errorf("--from-local needs --daemon, the images are read out of the local image store of the runtime")
+		}
+		if options.Daemon && options.Lock != "" {
+			return options,fmt.Errorf("--lock can't be used with --daemon, the runtime can't pin the images to their digests")
+		}
+		if options.Daemon && (options.AllPlatforms || len(options.Platforms) > 1) {
+			return options,fmt.Errorf("a single platform can be dumped with --daemon, dump without --daemon to keep several")
+		}
+	}
+
+	if load,_:=opts["load"].(bool);load {
+		options.KeepData,_=opts["--keep-data"].(bool)
+		options.Target,_=opts["--to"].(string)
+		if options.AllPlatforms || len(options.Platforms) > 1 {
+			return options,fmt.Errorf("load pulls a single platform")
+		}
+		if strings.TrimSpace(options.Target) != "" && len(options.Platforms) != 0 {
+			return options,fmt.Errorf("--platform can't be used with --to, the target registry gets every platform of the archive")
+		}
+	}
+	return options,nil
+}
+
+// failFast return true if --fail-fast is given, --keep-going, the default, goes through every image
+func failFast(opts docopt.Opts) bool{
+	failFast,_:=opts["--fail-fast"].(bool)
+	keepGoing,_:=opts["--keep-going"].(bool)
+	return failFast && !keepGoing
+}
+
+// platforms return the platforms of --platform, and true if it's all
+func platforms(opts docopt.Opts) ([]registry.Platform,bool,error){
+	platform,_:=opts["--platform"].(string)
+	platform=strings.TrimSpace(platform)
+	if platform == registry.PLATFORM_ALL {
+		return nil,true,nil
+	}
+	ret,err:=registry.ParsePlatforms(platform)
+	if err != nil {
+		return nil,false,err
+	}
+	return ret,false,nil
+}
+
+// retry return the retry policy of --retries, --retry-delay, --retry-max-delay and --retry-jitter,
+// the default one for the options left out
+func retry(opts docopt.Opts) (registry.RetryPolicy,error){
+	policy:=registry.NewDefaultRetryPolicy()
+	if retries,ok:=opts["--retries"].(string);ok {
+		n,err:=strconv.Atoi(strings.TrimSpace(retries))
+		if err != nil || n < 0 {
+			return policy,fmt.Errorf("--retries must be a number not below 0, got %s",retries)
+		}
+		policy.Retries=n
+	}
+	for name,delay:=range map[string]*time.Duration{"--retry-delay":&policy.Delay,"--retry-max-delay":&policy.MaxDelay}{
+		value,ok:=opts[name].(string)
+		if !ok {
+			continue
+		}
+		d,err:=time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return policy,fmt.Errorf("%s must be a duration such as 500ms or 2s, got %s",name,value)
+		}
+		*delay=d
+	}
+	if jitter,ok:=opts["--retry-jitter"].(string);ok {
+		f,err:=strconv.ParseFloat(strings.TrimSpace(jitter),64)
+		if err != nil || f < 0 || f > 1 {
+			return policy,fmt.Errorf("--retry-jitter must be a fraction from 0 to 1, got %s",jitter)
+		}
+		policy.Jitter=f
+	}
+	if policy.MaxDelay < policy.Delay {
+		return policy,fmt.Errorf("--retry-max-delay %s can't be shorter than --retry-delay %s",policy.MaxDelay,policy.Delay)
 	}
+	return policy,nil
+}
 
+// credentials return the registry credentials of the auth file, the default one if empty
+func credentials(authFile string) registry.CredentialFunc{
+	config,err:=registry.LoadDockerConfig(authFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return config.Credentials
+}
 
+// targetClient return the registry client of `load --to`, configured by --insecure, --username and the password,
+// see targetPassword. credentials answer the auth of the target registry unless --username is given
+func targetClient(opts docopt.Opts,credentials registry.CredentialFunc) (*registry.Client,error){
+	client:=registry.NewDefaultClient()
+	if opts["--insecure"].(bool) {
+		client=registry.NewInsecureClient()
+	}
+	client.Credentials=credentials
+	username,_:=opts["--username"].(string)
+	password,err:=targetPassword(opts,os.Stdin)
+	if err != nil {
+		return nil,err
+	}
+	if username != "" {
+		client.Credentials=func(host string) (string,string,error){
+			return username,password,nil
+		}
+	}
+	return client,nil
+}
+
+// targetPassword return the password of the target registry: the one of --password, the first line of stdin
+// with --password-stdin, otherwise the one of PASSWORD_ENV
+func targetPassword(opts docopt.Opts,stdin io.Reader) (string,error){
+	username,_:=opts["--username"].(string)
+	if password,ok:=opts["--password"].(string);ok {
+		log.Printf("warning: --password shows in ps and the shell history, use --password-stdin or $%s instead \n",PASSWORD_ENV)
+		return password,nil
+	}
+	if fromStdin,_:=opts["--password-stdin"].(bool);fromStdin {
+		if username == "" {
+			return "",fmt.Errorf("--password-stdin needs --username")
+		}
+		line,err:=bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "",fmt.Errorf("failed to read the password from stdin: %s",err.Error())
+		}
+		return strings.TrimRight(line,"\r\n"),nil
+	}
+	return os.Getenv(PASSWORD_ENV),nil
 }
 
 // BatchDump dump images in filename to tar.gz file specified by tarfile
-// it implements function provided by `image-batch dump -f <filename> <tarfile>`
-func BatchDump(filename string,tarfile string) error{
+// it implements function provided by `image-batch dump -f <filename> <tarfile>`.
+// images are fetched by the native registry client unless options.Daemon is true.
+// if options.Base is not empty, the blobs carried by the base archive are left out.
+// if options.Lock is not empty, the images of the lockfile are dumped by their digests and filename is ignored.
+// the images of the kubernetes manifests of options.FromK8s and of the compose files of options.FromCompose
+// are dumped along with the ones of filename, which may be empty. so are the local images matching the filters
+// of options.FromLocal, which are not pulled
+func BatchDump(ctx context.Context,filename string,tarfile string,options Options) error{
 
 	// parse the image list
-	list,err:=registry.ParseImagesFromFile(filename)
-	if err != nil {
-		return err
+	var list []string
+	var pins map[string]string
+	var resolved *registry.Platform
+	settings:=make(map[string]registry.ImageSettings)
+	if options.Lock != "" {
+		lock,err:=registry.ParseLockFromFile(options.Lock)
+		if err != nil {
+			return err
+		}
+		list=lock.References()
+		pins=lock.Images
+		// the platforms and the per-image settings are the locked ones, the ones of older lockfiles are not known
+		if lock.HasPlatforms() {
+			platforms,all,platform,err:=lock.PlatformsOf()
+			if err != nil {
+				return err
+			}
+			given:=registry.FormatPlatforms(options.Platforms,options.AllPlatforms)
+			if given != "" && given != lock.Platforms {
+				return fmt.Errorf("--platform %s differs from the platforms %q of lockfile %s, leave it out to dump the locked ones",given,lock.Platforms,options.Lock)
+			}
+			options.Platforms,options.AllPlatforms,resolved=platforms,all,&platform
+			settings,err=lock.ImageSettings()
+			if err != nil {
+				return err
+			}
+		}
+	}else{
+		entries:=make([]registry.ImageListEntry,0)
+		if filename != "" {
+			var err error
+			entries,err=registry.ParseImageList(filename)
+			if err != nil {
+				return err
+			}
+		}
+		entries,err:=registry.FilterGroups(entries,options.Groups)
+		if err != nil {
+			return err
+		}
+		// expand the image patterns through the catalog and tags APIs of their registries
+		client:=registry.NewDefaultClient()
+		client.Credentials=options.Credentials
+		entries,err=registry.ExpandImageList(ctx,client,entries)
+		if err != nil {
+			return err
+		}
+		// the images of the manifests are added with default settings, unless the image list has them already
+		for _,path:=range options.FromK8s{
+			images,err:=registry.ParseImagesFromK8s(path)
+			if err != nil {
+				return err
+			}
+			log.Printf("found %d images in the kubernetes manifests of %s \n",len(images),path)
+			for _,image:=range images{
+				entries=append(entries,registry.ImageListEntry{Reference:image})
+			}
+		}
+		for _,path:=range options.FromCompose{
+			images,warnings,err:=registry.ParseImagesFromCompose(path,options.EnvFile)
+			if err != nil {
+				return err
+			}
+			for _,warning:=range warnings{
+				log.Printf("warning: %s \n",warning)
+			}
+			log.Printf("found %d images in the compose file %s \n",len(images),path)
+			for _,image:=range images{
+				entries=append(entries,registry.ImageListEntry{Reference:image})
+			}
+		}
+		for _,entry:=range entries{
+			if _,ok:=settings[entry.Reference];ok {
+				continue
+			}
+			list=append(list,entry.Reference)
+			settings[entry.Reference]=entry.ImageSettings
+			if options.Daemon && (entry.AllPlatforms || len(entry.Platforms) != 0) {
+				return fmt.Errorf("image %s: per-image platforms can't be dumped with --daemon",entry.Reference)
+			}
+		}
+		// the local images are never pulled, they may have been built here and pushed nowhere
+		if len(options.FromLocal) != 0 {
+			images,err:=options.Runtime.ListImages(ctx,options.FromLocal)
+			if err != nil {
+				return err
+			}
+			log.Printf("found %d local images matching %s \n",len(images),strings.Join(options.FromLocal," "))
+			for _,image:=range images{
+				setting,ok:=settings[image]
+				if !ok {
+					list=append(list,image)
+				}
+				setting.PullPolicy=registry.PULL_POLICY_NEVER
+				settings[image]=setting
+			}
+		}
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("no images to dump")
 	}
-	// transform the image tag from registry.xx.com/repo/artifact:tag => localhost:5000/artifact:tag
+	// transform the image tag from registry.xx.com/repo/artifact:tag => localhost:5000/registry.xx.com/repo/artifact:tag
 	tagFromRemoteToLocal, err:=registry.TransformImageTag(list)
 	if err != nil {
 		return err
 	}
 
-	pd:=registry.NewDefaultParallelDocker(tagFromRemoteToLocal,true)
-	// pull the images
-	err=pd.PullImages(true)
-	if err != nil {
-		return err
+	if !options.Daemon {
+		// fetch the images straight into the data volume, no docker daemon needed
+		opts:=append(registry.NewDefaultOptions(),registry.WithFormat(options.Format),registry.WithBaseArchive(options.Base),
+			registry.WithPlatforms(options.Platforms,options.AllPlatforms),registry.WithPins(pins),
+			registry.WithImageSettings(settings),registry.WithCredentials(options.Credentials),registry.WithFailFast(options.FailFast),
+			registry.WithRetry(options.Retry),registry.WithWorkDir(options.WorkDir))
+		if resolved != nil {
+			opts=append(opts,registry.WithResolvedPlatform(*resolved))
+		}
+		reg:=registry.NewNativeRegistryWithImagesPredefined(tagFromRemoteToLocal,opts...)
+		return reg.Dump(ctx,tarfile)
 	}
-	// retag the images
-	err=pd.RetagImages(true)
+
+	pd:=registry.NewParallelDockerWithRuntime(tagFromRemoteToLocal,true,options.Runtime)
+	pd.PullPolicies=make(map[string]string)
+	for image,setting:=range settings{
+		pd.PullPolicies[image]=setting.PullPolicy
+	}
+	pd.FailFast=options.FailFast
+	pd.Retry=options.Retry
+	// pull the images, they are retagged onto the registry instance once it runs, see Registry.Dump
+	results,err:=pd.PullImages(ctx,true)
+	log.Printf("pull %s \n",results)
 	if err != nil {
 		return err
 	}
 
-	opts:=registry.NewDefaultOptions()
+	opts:=append(registry.NewDefaultOptions(),registry.WithBaseArchive(options.Base),registry.WithRuntime(options.Runtime),
+		registry.WithImageSettings(settings),registry.WithFailFast(options.FailFast),registry.WithRetry(options.Retry),
+		registry.WithWorkDir(options.WorkDir))
 	reg:=registry.NewDefaultRegistryWithImagesPredefined(tagFromRemoteToLocal,opts...)
 
 
 	// dump the compress tag.gz file
-	err=reg.Dump(tarfile)
+	err=reg.Dump(ctx,tarfile)
 	if err != nil {
 		return err
 	}
@@ -116,14 +635,142 @@ func BatchDump(filename string,tarfile string) error{
 
 
 // BatchLoad load images specified by tarfile
-// it implements function provided by `image-batch load <tarfile>`
-func BatchLoad(tarFile string) error{
+// it implements function provided by `image-batch load <tarfile>`.
+// a delta archive is refused unless the blobs of its base are in the kept registry data or in options.Base.
+// if options.Target is not empty, the images are pushed into the target registry instead of the container runtime
+func BatchLoad(ctx context.Context,tarFile string,options Options) error{
 
-	opts:=registry.NewDefaultOptions()
+	opts:=append(registry.NewDefaultOptions(),
+		registry.WithBaseArchive(options.Base),
+		registry.WithKeepData(options.KeepData),
+		registry.WithTarget(options.Target,options.TargetClient),
+		registry.WithRuntime(options.Runtime),
+		registry.WithPlatforms(options.Platforms,false),
+		registry.WithFailFast(options.FailFast),
+		registry.WithRetry(options.Retry),
+		registry.WithWorkDir(options.WorkDir))
 	reg:=registry.NewDefaultRegistry(opts...)
-	err:=reg.Load(tarFile)
+	err:=reg.Load(ctx,tarFile)
 	if err != nil {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+
+// BatchVerify verify the integrity of tarfile without loading it
+// it implements function provided by `image-batch verify <tarfile>`.
+// the sha256 of every blob is checked against its digest, and every image must resolve to blobs which are present
+func BatchVerify(tarFile string) error{
+	report,err:=registry.VerifyArchive(tarFile)
+	if err != nil {
+		return err
+	}
+	for _,image:=range report.Images{
+		if len(image.Problems) == 0 {
+			fmt.Printf("ok      %s %s\n",image.Reference,image.Digest)
+			continue
+		}
+		fmt.Printf("FAILED  %s %s\n",image.Reference,image.Digest)
+		for _,problem:=range image.Problems{
+			fmt.Printf("        %s\n",problem)
+		}
+	}
+	for _,corrupted:=range report.Corrupted{
+		fmt.Printf("CORRUPT %s\n",corrupted)
+	}
+	fmt.Printf("%s archive, %d images, %d blobs intact, %d corrupted, %d carried by the base archive\n",
+		report.Format,len(report.Images),report.Blobs,len(report.Corrupted),report.Base)
+	if !report.OK() {
+		return fmt.Errorf("archive %s failed verification",tarFile)
+	}
+	return nil
+}
+
+// BatchCleanup remove what crashed runs of dump and load left behind: the registry containers of rt, which may be nil,
+// and the staging dirs of workDir, the temp dir if empty. it implements function provided by `image-batch cleanup`.
+// nothing is removed if dryRun is true
+func BatchCleanup(ctx context.Context,rt registry.Runtime,workDir string,dryRun bool) error{
+	if workDir == "" {
+		workDir=os.TempDir()
+	}
+	leftovers,err:=registry.FindLeftovers(ctx,rt,workDir)
+	if err != nil {
+		return err
+	}
+	if len(leftovers) == 0 {
+		fmt.Println("nothing left behind")
+		return nil
+	}
+	for _,leftover:=range leftovers{
+		fmt.Println(leftover)
+	}
+	if dryRun {
+		fmt.Printf("%d leftovers found, run without --dry-run to remove them\n",len(leftovers))
+		return nil
+	}
+	err=registry.RemoveLeftovers(ctx,rt,leftovers)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d leftovers removed\n",len(leftovers))
+	return nil
+}
+
+// BatchInspect list the images of tarfile without loading it
+// it implements function provided by `image-batch inspect <tarfile>`, output is table or json
+func BatchInspect(tarFile string,output string) error{
+	if output != OUTPUT_TABLE && output != OUTPUT_JSON {
+		return fmt.Errorf("unknown output %s, must be %s or %s",output,OUTPUT_TABLE,OUTPUT_JSON)
+	}
+	images,err:=registry.InspectArchive(tarFile)
+	if err != nil {
+		return err
+	}
+	if output == OUTPUT_JSON {
+		bytes,err:=json.MarshalIndent(images,"","  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	w:=tabwriter.NewWriter(os.Stdout,0,4,2,' ',0)
+	fmt.Fprintln(w,"REFERENCE\tLOCAL TAG\tDIGEST\tPLATFORMS\tSIZE\tLAYERS\tSHARED")
+	for _,image:=range images{
+		platforms:=strings.Join(image.Platforms,",")
+		if platforms == "" {
+			platforms="-"
+		}
+		localTag:=image.LocalTag
+		if localTag == "" {
+			localTag="-"
+		}
+		fmt.Fprintf(w,"%s\t%s\t%s\t%s\t%s\t%d\t%d\n",image.Reference,localTag,shortDigest(image.Digest),
+			platforms,formatSize(image.Size),image.Layers,image.SharedLayers)
+	}
+	return w.Flush()
+}
+
+// shortDigest truncate sha256:<hex> to 12 hex digits like docker does
+func shortDigest(digest string) string{
+	if len(digest) > len("sha256:")+12 {
+		return digest[:len("sha256:")+12]
+	}
+	return digest
+}
+
+// formatSize format bytes in a human readable unit, such as 12.3MB
+func formatSize(size int64) string{
+	units:=[]string{"B","KB","MB","GB","TB"}
+	value:=float64(size)
+	unit:=0
+	for value >= 1000 && unit < len(units)-1 {
+		value/=1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s",size,units[unit])
+	}
+	return fmt.Sprintf("%.1f%s",value,units[unit])
+}
@@ -1,7 +1,208 @@
 package cmd
 
-import "testing"
+import (
+	"context"
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"imagebatcher/registry"
+)
 
 func TestBatchDump(t *testing.T) {
 
 }
+
+// parseArgs parse argv as the command line of image-batch, failing the test instead of exiting
+func parseArgs(t *testing.T, argv string) docopt.Opts {
+	parser := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	opts, err := parser.ParseArgs(usage, strings.Fields(argv), "v1.0")
+	if err != nil {
+		t.Fatalf("%s: %s", argv, err.Error())
+	}
+	return opts
+}
+
+func TestParseOptions(t *testing.T) {
+	defaults := registry.NewDefaultRetryPolicy()
+	cases := []struct {
+		argv  string
+		check func(options Options) bool
+	}{
+		{"dump -f images.txt dump.tar.gz", func(o Options) bool {
+			return !o.Daemon && o.Format == registry.FORMAT_REGISTRY && !o.FailFast && o.WorkDir == "" && o.Retry == defaults
+		}},
+		{"dump --fail-fast -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.FailFast
+		}},
+		{"dump --keep-going -f images.txt dump.tar.gz", func(o Options) bool {
+			return !o.FailFast
+		}},
+		{"dump --format oci -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.Format == registry.FORMAT_OCI
+		}},
+		{"dump --daemon -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.Daemon
+		}},
+		{"dump --retries 5 --retry-delay 500ms --retry-max-delay 10s --retry-jitter 0.5 -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.Retry == registry.RetryPolicy{Retries: 5, Delay: 500 * time.Millisecond, MaxDelay: 10 * time.Second, Jitter: 0.5}
+		}},
+		{"dump --retries 0 -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.Retry.Retries == 0 && o.Retry.Delay == defaults.Delay
+		}},
+		{"dump --platform linux/amd64,linux/arm64 --format oci -f images.txt dump.tar.gz", func(o Options) bool {
+			return len(o.Platforms) == 2 && o.Platforms[1].Architecture == "arm64" && !o.AllPlatforms
+		}},
+		{"dump --platform all -f images.txt dump.tar.gz", func(o Options) bool {
+			return o.AllPlatforms && o.Platforms == nil
+		}},
+		{"dump --lock images.lock dump.tar.gz", func(o Options) bool {
+			return o.Lock == "images.lock"
+		}},
+		{"dump --group a --group b -f images.yaml dump.tar.gz", func(o Options) bool {
+			return len(o.Groups) == 2 && o.Groups[1] == "b"
+		}},
+		{"dump --daemon --from-local reference=myapp/* dump.tar.gz", func(o Options) bool {
+			return o.Daemon && len(o.FromLocal) == 1 && o.FromLocal[0] == "reference=myapp/*"
+		}},
+		{"dump --workdir /data/tmp -f images.yaml dump.tar.gz", func(o Options) bool {
+			return o.WorkDir == "/data/tmp"
+		}},
+		{"load --workdir /data/tmp --keep-data --base base.tar.gz dump.tar.gz", func(o Options) bool {
+			return o.WorkDir == "/data/tmp" && o.KeepData && o.Base == "base.tar.gz" && o.Target == ""
+		}},
+		{"load --to registry.internal:5000/offline dump.tar.gz", func(o Options) bool {
+			return o.Target == "registry.internal:5000/offline"
+		}},
+		{"cleanup --workdir /data/tmp --dry-run", func(o Options) bool {
+			return o.WorkDir == "/data/tmp"
+		}},
+	}
+	for _, c := range cases {
+		options, err := parseOptions(parseArgs(t, c.argv))
+		if err != nil {
+			t.Errorf("%s: %s", c.argv, err.Error())
+			continue
+		}
+		if !c.check(options) {
+			t.Errorf("%s: unexpected options %+v", c.argv, options)
+		}
+	}
+}
+
+func TestParseOptions_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"dump --retries -1 -f images.txt dump.tar.gz":                          "--retries",
+		"dump --retries three -f images.txt dump.tar.gz":                       "--retries",
+		"dump --retry-delay 2 -f images.txt dump.tar.gz":                       "--retry-delay",
+		"dump --retry-jitter 1.5 -f images.txt dump.tar.gz":                    "--retry-jitter",
+		"dump --retry-delay 1m --retry-max-delay 1s -f images.txt dump.tar.gz": "can't be shorter",
+		"dump --format tar -f images.txt dump.tar.gz":                          "unknown format",
+		"dump --daemon --format oci -f images.txt dump.tar.gz":                 "--daemon",
+		"dump --daemon --lock images.lock dump.tar.gz":                         "--lock",
+		"dump --from-local reference=myapp/* dump.tar.gz":                      "--from-local",
+		"dump --platform linux -f images.txt dump.tar.gz":                      "linux",
+		"dump --daemon --platform all -f images.txt dump.tar.gz":               "single platform",
+		"load --platform linux/amd64,linux/arm64 dump.tar.gz":                  "single platform",
+		"load --to registry.internal:5000 --platform linux/amd64 dump.tar.gz":  "--to",
+	}
+	for argv, want := range cases {
+		_, err := parseOptions(parseArgs(t, argv))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want an error about %s, got %v", argv, want, err)
+		}
+	}
+}
+
+func TestParse_Exclusive(t *testing.T) {
+	parser := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	_, err := parser.ParseArgs(usage, strings.Fields("load --fail-fast --keep-going dump.tar.gz"), "v1.0")
+	if err == nil {
+		t.Error("--fail-fast and --keep-going should be refused together")
+	}
+}
+
+func TestBatchDump_LockPlatforms(t *testing.T) {
+	lockfile := paths.Join(t.TempDir(), "images.lock")
+	os.WriteFile(lockfile, []byte(`{"version":2,"images":{"nginx:1.25":"sha256:`+strings.Repeat("0", 64)+`"},
+"platforms":"linux/amd64,linux/arm64","platform":"linux/amd64"}`), 0644)
+	platforms, _ := registry.ParsePlatforms("linux/amd64")
+
+	// the dump fails before fetching anything
+	err := BatchDump(context.Background(), "", paths.Join(t.TempDir(), "dump.tar.gz"), Options{Lock: lockfile, Platforms: platforms})
+	if err == nil || !strings.Contains(err.Error(), "differs from the platforms") {
+		t.Errorf("a --platform other than the locked one should be refused, got %v", err)
+	}
+}
+
+func TestTargetPassword(t *testing.T) {
+	t.Setenv(PASSWORD_ENV, "from-env")
+	cases := []struct {
+		argv  string
+		stdin string
+		want  string
+	}{
+		{"load --to registry.internal:5000 --username ci dump.tar.gz", "", "from-env"},
+		{"load --to registry.internal:5000 --username ci --password-stdin dump.tar.gz", "from-stdin\nignored\n", "from-stdin"},
+		{"load --to registry.internal:5000 --username ci --password-stdin dump.tar.gz", "no-newline", "no-newline"},
+		{"load --to registry.internal:5000 --username ci --password from-argv dump.tar.gz", "", "from-argv"},
+	}
+	for _, c := range cases {
+		password, err := targetPassword(parseArgs(t, c.argv), strings.NewReader(c.stdin))
+		if err != nil || password != c.want {
+			t.Errorf("%s: want %s, got %s %v", c.argv, c.want, password, err)
+		}
+	}
+	if _, err := targetPassword(parseArgs(t, "load --to registry.internal:5000 --password-stdin dump.tar.gz"), strings.NewReader("")); err == nil {
+		t.Error("--password-stdin should need --username")
+	}
+	parser := &docopt.Parser{HelpHandler: docopt.NoHelpHandler}
+	if _, err := parser.ParseArgs(usage, strings.Fields("load --password a --password-stdin dump.tar.gz"), "v1.0"); err == nil {
+		t.Error("--password and --password-stdin should be refused together")
+	}
+}
+
+func TestBatchCleanup_WorkDir(t *testing.T) {
+	// the work dir defaults to the temp dir
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	dead := paths.Join(tmp, registry.STAGING_DIR_PREFIX+"dead")
+	os.MkdirAll(dead, 0755)
+	os.WriteFile(paths.Join(dead, registry.MARKER_FILE_NAME), []byte(`{"pid":999999,"command":"dump","ownsData":true}`), 0644)
+
+	err := BatchCleanup(context.Background(), nil, "", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dead); err != nil {
+		t.Fatal("a dry run should remove nothing")
+	}
+	// another work dir is left alone
+	if err := BatchCleanup(context.Background(), nil, t.TempDir(), false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dead); err != nil {
+		t.Fatal("the leftovers of another work dir should be left alone")
+	}
+	if err := BatchCleanup(context.Background(), nil, "", false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dead); err == nil {
+		t.Error("the leftovers of the temp dir should be removed")
+	}
+}
+
+func TestInterruptContext(t *testing.T) {
+	ctx, stop := interruptContext()
+	defer stop()
+	process, _ := os.FindProcess(os.Getpid())
+	process.Signal(os.Interrupt)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGINT should cancel the context")
+	}
+}
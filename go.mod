@@ -3,3 +3,5 @@ module imagebatcher
 go 1.18
 
 require github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,346 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	paths "path"
+	"sort"
+	"strings"
+)
+
+// this section reads an archive written by dump in a single pass, without extracting it,
+// so it can be verified or listed before it's loaded
+
+// ArchiveContents is what ScanArchive found in an archive
+type ArchiveContents struct {
+	// Format of the archive, FORMAT_REGISTRY or FORMAT_OCI
+	Format string
+
+	// Blobs is digest => size of the blobs whose content matches their digest
+	Blobs map[string]int64
+
+	// Corrupted is digest => reason of the blobs whose content doesn't match their digest
+	Corrupted map[string]string
+
+	// Manifests is digest => manifest of the blobs which are image manifests or manifest lists
+	Manifests map[string]*Manifest
+
+	// Configs is digest => platform of the blobs which are image configs
+	Configs map[string]Platform
+
+	// Tags is repo:tag => manifest digest, read from the tag links of the registry layout
+	Tags map[string]string
+
+	// Revisions is repo@digest of the manifests linked into a repository of the registry layout
+	Revisions map[string]bool
+
+	// Layers is repo@digest of the blobs linked into a repository of the registry layout
+	Layers map[string]bool
+
+	// ImageList is images.json of the registry layout, remote => local tag
+	ImageList map[string]string
+
+	// Index is index.json of the OCI layout
+	Index *Manifest
+
+	// Delta is delta.json, nil unless the archive is dumped against a base
+	Delta *Delta
+
+	// Lock is images.lock, nil if the archive is dumped by the runtime
+	Lock *Lockfile
+}
+
+// ArchiveImage is an image of the archive resolved from the image list
+type ArchiveImage struct {
+	// Reference is the original image reference, such as nginx:1.25
+	Reference string `json:"reference"`
+
+	// LocalTag is the tag of the image in the registry layout, empty in the OCI layout
+	LocalTag string `json:"localTag,omitempty"`
+
+	// Digest of the manifest, or of the manifest list
+	Digest string `json:"digest"`
+
+	// MediaType of the manifest
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Platforms of the image, read from its config. the ones whose manifests are present
+	// if the image is a manifest list
+	Platforms []Platform `json:"platforms,omitempty"`
+
+	// Blobs are the manifests, configs and layers of the image
+	Blobs []string `json:"-"`
+
+	// Layers of the image, of every platform present
+	Layers []string `json:"-"`
+
+	// Problems found resolving the image, empty if the image can be loaded
+	Problems []string `json:"problems,omitempty"`
+}
+
+// ScanArchive stream the tar.gz archive, checking the sha256 of every blob against its digest
+// and keeping the manifests, the links and the image list
+func ScanArchive(path string) (*ArchiveContents, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("archive %s: %s", path, err.Error())
+	}
+	c := &ArchiveContents{
+		Format:    FORMAT_REGISTRY,
+		Blobs:     make(map[string]int64),
+		Corrupted: make(map[string]string),
+		Manifests: make(map[string]*Manifest),
+		Configs:   make(map[string]Platform),
+		Tags:      make(map[string]string),
+		Revisions: make(map[string]bool),
+		Layers:    make(map[string]bool),
+	}
+	reader := tar.NewReader(gz)
+	for first := true; ; first = false {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %s", path, err.Error())
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if first && name == "oci-layout" {
+			c.Format = FORMAT_OCI
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = c.scanEntry(name, header.Size, reader)
+		if err != nil {
+			return nil, fmt.Errorf("archive %s: %s: %s", path, name, err.Error())
+		}
+	}
+	return c, nil
+}
+
+// scanEntry read the entry name of the archive
+func (c *ArchiveContents) scanEntry(name string, size int64, r io.Reader) error {
+	if digest, ok := blobDigestFromPath(name); ok {
+		return c.scanBlob(digest, size, r)
+	}
+	if i := strings.Index(name, REGISTRY_STORAGE_ROOT+"/repositories/"); i >= 0 {
+		return c.scanLink(strings.TrimPrefix(name[i:], REGISTRY_STORAGE_ROOT+"/repositories/"), r)
+	}
+	switch {
+	case paths.Base(name) == "images.json":
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		index, err := ParseImageIndex(body)
+		if err != nil {
+			return err
+		}
+		c.ImageList = index.Pairs()
+		return nil
+	case paths.Base(name) == DELTA_FILE_NAME:
+		c.Delta = &Delta{}
+		return json.NewDecoder(r).Decode(c.Delta)
+	case paths.Base(name) == LOCK_FILE_NAME:
+		c.Lock = &Lockfile{}
+		return json.NewDecoder(r).Decode(c.Lock)
+	case name == "index.json" && c.Format == FORMAT_OCI:
+		body, err := io.ReadAll(io.LimitReader(r, MAX_MANIFEST_SIZE))
+		if err != nil {
+			return err
+		}
+		c.Index, err = ParseManifest(body, MEDIA_TYPE_OCI_INDEX)
+		return err
+	}
+	return nil
+}
+
+// scanBlob hash the content of the blob, the small ones are kept if they are manifests
+func (c *ArchiveContents) scanBlob(digest string, size int64, r io.Reader) error {
+	hash := sha256.New()
+	var body bytes.Buffer
+	w := io.Writer(hash)
+	if size <= MAX_MANIFEST_SIZE {
+		w = io.MultiWriter(hash, &body)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	actual := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if actual != digest {
+		c.Corrupted[digest] = fmt.Sprintf("content is %s", actual)
+		return nil
+	}
+	c.Blobs[digest] = n
+	if body.Len() == 0 || body.Bytes()[0] != '{' {
+		return nil
+	}
+	if m, err := ParseManifest(body.Bytes(), ""); err == nil && (len(m.Layers) != 0 || len(m.Manifests) != 0 || m.Config != nil) {
+		c.Manifests[digest] = m
+		return nil
+	}
+	var config Platform
+	if json.Unmarshal(body.Bytes(), &config) == nil && config.OS != "" && config.Architecture != "" {
+		c.Configs[digest] = config
+	}
+	return nil
+}
+
+// scanLink read a link under the repositories dir of the registry layout, name is relative to it
+func (c *ArchiveContents) scanLink(name string, r io.Reader) error {
+	if paths.Base(name) != "link" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return err
+	}
+	target := strings.TrimSpace(string(body))
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		repo := strings.Join(parts[:i], "/")
+		rest := parts[i+1:]
+		switch {
+		case part == "_manifests" && len(rest) == 4 && rest[0] == "tags" && rest[2] == "current":
+			c.Tags[repo+":"+rest[1]] = target
+		case part == "_manifests" && len(rest) == 4 && rest[0] == "revisions" && rest[1] == "sha256":
+			c.Revisions[repo+"@sha256:"+rest[2]] = true
+		case part == "_layers" && len(rest) == 3 && rest[0] == "sha256":
+			c.Layers[repo+"@sha256:"+rest[1]] = true
+		default:
+			continue
+		}
+		return nil
+	}
+	return nil
+}
+
+// fromBase return true if the blob is left out of the archive as its base carries it
+func (c *ArchiveContents) fromBase(digest string) bool {
+	if c.Delta == nil {
+		return false
+	}
+	for _, blob := range c.Delta.Blobs {
+		if blob == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// Images resolve every image of the archive to its manifests and blobs, sorted by reference
+func (c *ArchiveContents) Images() []*ArchiveImage {
+	ret := make([]*ArchiveImage, 0)
+	if c.Format == FORMAT_OCI {
+		if c.Index == nil {
+			return ret
+		}
+		for _, desc := range c.Index.Manifests {
+			image := &ArchiveImage{Reference: desc.Annotations[ANNOTATION_REF_NAME], Digest: desc.Digest, MediaType: desc.MediaType}
+			c.resolve(image, "", desc.Digest, true)
+			ret = append(ret, image)
+		}
+	} else {
+		for reference, localTag := range c.ImageList {
+			image := &ArchiveImage{Reference: reference, LocalTag: localTag}
+			_, repo, tag := splitRemoteImage(localTag)
+			image.Digest = c.Tags[repo+":"+tag]
+			if image.Digest == "" {
+				image.Problems = append(image.Problems, fmt.Sprintf("tag %s is missing", localTag))
+			} else {
+				c.resolve(image, repo, image.Digest, true)
+			}
+			ret = append(ret, image)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Reference < ret[j].Reference
+	})
+	return ret
+}
+
+// resolve walk the manifest digest of image, recording its blobs and the problems found.
+// repo is the repository of the registry layout the manifest and blobs must be linked into
+func (c *ArchiveContents) resolve(image *ArchiveImage, repo string, digest string, top bool) {
+	image.Blobs = append(image.Blobs, digest)
+	if !c.present(image, "manifest", digest) {
+		return
+	}
+	if repo != "" && !top && !c.Revisions[repo+"@"+digest] {
+		image.Problems = append(image.Problems, fmt.Sprintf("manifest %s is not linked into %s", digest, repo))
+	}
+	if _, ok := c.Blobs[digest]; !ok {
+		// carried by the base, its content is unknown
+		return
+	}
+	m, ok := c.Manifests[digest]
+	if !ok {
+		image.Problems = append(image.Problems, fmt.Sprintf("blob %s is not a manifest", digest))
+		return
+	}
+	if top {
+		image.MediaType = m.MediaType
+	}
+	if IsIndexMediaType(m.MediaType) {
+		found := false
+		for _, desc := range m.Manifests {
+			if _, ok := c.Blobs[desc.Digest]; !ok && !c.fromBase(desc.Digest) && c.Corrupted[desc.Digest] == "" {
+				// left out by dump --platform
+				continue
+			}
+			found = true
+			if desc.Platform != nil {
+				image.Platforms = append(image.Platforms, *desc.Platform)
+			}
+			c.resolve(image, repo, desc.Digest, false)
+		}
+		if !found {
+			image.Problems = append(image.Problems, fmt.Sprintf("manifest list %s has none of its manifests", digest))
+		}
+		return
+	}
+	if top && m.Config != nil {
+		if platform, ok := c.Configs[m.Config.Digest]; ok {
+			image.Platforms = append(image.Platforms, platform)
+		}
+	}
+	for _, layer := range m.Layers {
+		image.Layers = append(image.Layers, layer.Digest)
+	}
+	for _, blob := range m.Blobs() {
+		image.Blobs = append(image.Blobs, blob.Digest)
+		if !c.present(image, "blob", blob.Digest) {
+			continue
+		}
+		if repo != "" && !c.Layers[repo+"@"+blob.Digest] {
+			image.Problems = append(image.Problems, fmt.Sprintf("blob %s is not linked into %s", blob.Digest, repo))
+		}
+	}
+}
+
+// present return true if the blob is in the archive or carried by its base, otherwise record the problem
+func (c *ArchiveContents) present(image *ArchiveImage, kind string, digest string) bool {
+	if _, ok := c.Blobs[digest]; ok || c.fromBase(digest) {
+		return true
+	}
+	if reason, ok := c.Corrupted[digest]; ok {
+		image.Problems = append(image.Problems, fmt.Sprintf("%s %s is corrupted, %s", kind, digest, reason))
+	} else {
+		image.Problems = append(image.Problems, fmt.Sprintf("%s %s is missing", kind, digest))
+	}
+	return false
+}
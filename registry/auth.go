@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// this section reads the registry credentials of docker's config.json: the `auths` logged in by
+// `docker login`, and the credential helpers of `credHelpers` and `credsStore`
+
+var (
+	// DOCKER_CONFIG_ENV names the directory of config.json instead of ~/.docker
+	DOCKER_CONFIG_ENV = "DOCKER_CONFIG"
+
+	// DOCKER_CONFIG_FILE_NAME is the name of the config file in its directory
+	DOCKER_CONFIG_FILE_NAME = "config.json"
+
+	// DOCKER_HUB_AUTH_KEY is the key docker stores the credentials of docker hub under
+	DOCKER_HUB_AUTH_KEY = "https://index.docker.io/v1/"
+
+	// CREDENTIAL_HELPER_PREFIX prefix the name of a credential helper to get its binary
+	CREDENTIAL_HELPER_PREFIX = "docker-credential-"
+
+	// CREDENTIAL_HELPER_TIMEOUT bounds a run of a credential helper, such as one waiting for a keychain to be unlocked
+	CREDENTIAL_HELPER_TIMEOUT = 30 * time.Second
+
+	// IDENTITY_TOKEN_USERNAME is the username of credentials whose secret is an identity token
+	IDENTITY_TOKEN_USERNAME = "<token>"
+
+	// errCredentialsNotFound is returned by a credential helper knowing nothing of a host
+	errCredentialsNotFound = errors.New("credentials not found")
+)
+
+// DockerConfig is the part of docker's config.json holding registry credentials. podman's auth.json
+// has the same format
+type DockerConfig struct {
+	// Auths are the credentials by registry, stored by `docker login`
+	Auths map[string]DockerAuth `json:"auths,omitempty"`
+
+	// CredHelpers are the credential helpers by registry, such as ecr-login
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+
+	// CredsStore is the credential helper of the registries without one of their own, such as desktop
+	CredsStore string `json:"credsStore,omitempty"`
+}
+
+// DockerAuth is the credentials of a registry
+type DockerAuth struct {
+	// Auth is base64 of username:password
+	Auth string `json:"auth,omitempty"`
+
+	Username string `json:"username,omitempty"`
+
+	Password string `json:"password,omitempty"`
+
+	// IdentityToken is the refresh token of the registry, used instead of the password
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DefaultAuthFile return $DOCKER_CONFIG/config.json, or ~/.docker/config.json
+func DefaultAuthFile() string {
+	if dir := os.Getenv(DOCKER_CONFIG_ENV); dir != "" {
+		return filepath.Join(dir, DOCKER_CONFIG_FILE_NAME)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", DOCKER_CONFIG_FILE_NAME)
+}
+
+// LoadDockerConfig read the config file at path, DefaultAuthFile if path is empty.
+// a missing default file is an empty config, a missing file given explicitly is an error
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultAuthFile()
+	}
+	config := &DockerConfig{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return config, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("auth file %s: %s", path, err.Error())
+	}
+	return config, nil
+}
+
+// Credentials return the username and password of host, it's a CredentialFunc.
+// the credential helper of the host is asked first, then the credsStore, then auths
+func (c *DockerConfig) Credentials(host string) (string, string, error) {
+	for _, key := range authKeys(host) {
+		if helper, ok := c.CredHelpers[key]; ok {
+			return runCredentialHelper(helper, key)
+		}
+	}
+	if c.CredsStore != "" {
+		for _, key := range authKeys(host) {
+			username, password, err := runCredentialHelper(c.CredsStore, key)
+			if err == nil {
+				return username, password, nil
+			}
+			if !errors.Is(err, errCredentialsNotFound) {
+				return "", "", err
+			}
+		}
+	}
+	for key, auth := range c.Auths {
+		if normalizeAuthKey(key) != normalizeAuthKey(host) {
+			continue
+		}
+		return auth.credentials(key)
+	}
+	return "", "", nil
+}
+
+func (a DockerAuth) credentials(key string) (string, string, error) {
+	if a.IdentityToken != "" {
+		return IDENTITY_TOKEN_USERNAME, a.IdentityToken, nil
+	}
+	if a.Auth == "" {
+		return a.Username, a.Password, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("auth of %s: %s", key, err.Error())
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("auth of %s is not username:password", key)
+	}
+	return username, password, nil
+}
+
+// authKeys return the keys the credentials of host may be stored under, docker hub has its own
+func authKeys(host string) []string {
+	if normalizeAuthKey(host) == DOCKER_HUB_HOST {
+		return []string{DOCKER_HUB_AUTH_KEY, DOCKER_HUB_HOST, DOCKER_HUB_LEGACY_HOST, DOCKER_HUB_ENDPOINT}
+	}
+	return []string{host, "https://" + host, "http://" + host}
+}
+
+// normalizeAuthKey return the host of a key of auths, such as https://registry.example.com/v1/ => registry.example.com
+func normalizeAuthKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key, _, _ = strings.Cut(key, "/")
+	key = strings.ToLower(key)
+	if key == DOCKER_HUB_LEGACY_HOST || key == DOCKER_HUB_ENDPOINT {
+		return DOCKER_HUB_HOST
+	}
+	return key
+}
+
+// runCredentialHelper ask the credential helper docker-credential-<helper> for the credentials of serverURL,
+// it's killed after CREDENTIAL_HELPER_TIMEOUT
+func runCredentialHelper(helper string, serverURL string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CREDENTIAL_HELPER_TIMEOUT)
+	defer cancel()
+	stdout, stderr, err := EXECUTOR.Run(ctx, []string{CREDENTIAL_HELPER_PREFIX + helper, "get"}, strings.NewReader(serverURL))
+	if err != nil {
+		// the helpers print it to stdout
+		if strings.Contains(stdout+stderr, "credentials not found") {
+			return "", "", errCredentialsNotFound
+		}
+		return "", "", fmt.Errorf("credential helper %s%s: %s %s", CREDENTIAL_HELPER_PREFIX, helper, err.Error(), strings.TrimSpace(stdout))
+	}
+	var ret struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal([]byte(stdout), &ret)
+	if err != nil {
+		return "", "", fmt.Errorf("credential helper %s%s: %s", CREDENTIAL_HELPER_PREFIX, helper, err.Error())
+	}
+	return ret.Username, ret.Secret, nil
+}
@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"encoding/base64"
+	"os"
+	paths "path"
+	"testing"
+)
+
+// writeCredentialHelper write docker-credential-<name> into dir, answering username and secret for
+// serverURL and "credentials not found" otherwise
+func writeCredentialHelper(t *testing.T, dir string, name string, serverURL string, username string, secret string) {
+	script := `#!/bin/sh
+read url
+if [ "$url" = "` + serverURL + `" ]; then
+  echo '{"ServerURL":"` + serverURL + `","Username":"` + username + `","Secret":"` + secret + `"}'
+  exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+	err := os.WriteFile(paths.Join(dir, CREDENTIAL_HELPER_PREFIX+name), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestDockerConfig_Credentials(t *testing.T) {
+	dir := t.TempDir()
+	writeCredentialHelper(t, dir, "ecr", "123.dkr.ecr.aws.com", "AWS", "ecr-secret")
+	writeCredentialHelper(t, dir, "desktop", DOCKER_HUB_AUTH_KEY, "hubuser", "hub-secret")
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	file := writeImageList(t, dir, "auth.json", `{
+  "auths": {
+    "https://registry.example.com/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("alice:s3cr:et"))+`"},
+    "registry.token.com": {"identitytoken": "refresh"},
+    "registry.plain.com": {"username": "bob", "password": "pw"}
+  },
+  "credHelpers": {"123.dkr.ecr.aws.com": "ecr"},
+  "credsStore": "desktop"
+}`)
+	config, err := LoadDockerConfig(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cases := map[string][2]string{
+		"registry.example.com": {"alice", "s3cr:et"},
+		"registry.token.com":   {IDENTITY_TOKEN_USERNAME, "refresh"},
+		"registry.plain.com":   {"bob", "pw"},
+		"123.dkr.ecr.aws.com":  {"AWS", "ecr-secret"},
+		"docker.io":            {"hubuser", "hub-secret"},
+		"registry.unknown.com": {"", ""},
+	}
+	for host, want := range cases {
+		username, password, err := config.Credentials(host)
+		if err != nil {
+			t.Errorf("%s: %s", host, err.Error())
+			continue
+		}
+		if [2]string{username, password} != want {
+			t.Errorf("%s: got %s:%s, want %v", host, username, password, want)
+		}
+	}
+
+	if _, err := LoadDockerConfig(paths.Join(dir, "missing.json")); err == nil {
+		t.Error("a missing auth file given explicitly should be reported")
+	}
+	t.Setenv(DOCKER_CONFIG_ENV, paths.Join(dir, "missing"))
+	if config, err := LoadDockerConfig(""); err != nil || len(config.Auths) != 0 {
+		t.Errorf("a missing default auth file should be an empty config, got %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// this section finds what a crashed dump or load left behind: the registry container, told by its labels,
+// and the staging dirs and the kept data dir of the work dir, told by the marker file written into them.
+// the leftovers of a run which is still going on, and whatever image-batch didn't create, are never touched
+
+var (
+	// OWNER_LABEL is set to OWNER_LABEL_VALUE on the containers image-batch runs
+	OWNER_LABEL       = "io.image-batch.owner"
+	OWNER_LABEL_VALUE = "image-batch"
+
+	// PID_LABEL is the pid of the image-batch process which ran the container
+	PID_LABEL = "io.image-batch.pid"
+
+	// HOST_LABEL is the HOST_ID of the host the container was run from, its PID_LABEL means nothing elsewhere
+	HOST_LABEL = "io.image-batch.host"
+
+	// HOST_ID tells apart the hosts, or containers, sharing the daemon of a runtime: the hostname and machine id
+	HOST_ID = hostID()
+
+	// MARKER_FILE_NAME is the marker file of the staging dirs and the kept data dir, see Marker
+	MARKER_FILE_NAME = ".image-batch.json"
+
+	// STAGING_DIR_PREFIX is the prefix of the staging dir each dump and load creates in the work dir
+	STAGING_DIR_PREFIX = "image-batch-"
+
+	// KEPT_DATA_DIR_NAME is the dir of the work dir load --keep-data keeps the registry data in
+	KEPT_DATA_DIR_NAME = "image-batch-data"
+
+	// CLEANUP_TIMEOUT bounds the commands cleaning up after a run, such as removing its tags or its registry
+	// container. they are run once the run is canceled too, so its context can't bound them
+	CLEANUP_TIMEOUT = time.Minute
+
+	// kinds of Leftover
+	LEFTOVER_CONTAINER = "container"
+	LEFTOVER_DATA      = "data"
+	LEFTOVER_FILE      = "file"
+)
+
+// Marker tells a dir is in use by a run of dump or load
+type Marker struct {
+	// PID of the image-batch process of the run
+	PID int `json:"pid"`
+
+	// Command of the run, dump or load
+	Command string `json:"command"`
+
+	// Created is when the run started
+	Created time.Time `json:"created"`
+
+	// OwnsData is true if the run created the dir, which is removed along with the marker.
+	// otherwise the dir is the data kept by a previous load, only the marker is removed
+	OwnsData bool `json:"ownsData"`
+}
+
+// Leftover is something a crashed run left behind
+type Leftover struct {
+	// Kind is LEFTOVER_CONTAINER, LEFTOVER_DATA or LEFTOVER_FILE
+	Kind string
+
+	// Path of the dir or file, or the id of the container
+	Path string
+
+	// Name of the container
+	Name string
+
+	// PID of the run which left it behind, 0 if unknown
+	PID int
+}
+
+func (l Leftover) String() string {
+	s := l.Kind + " " + l.Path
+	if l.Kind == LEFTOVER_CONTAINER {
+		s = fmt.Sprintf("container %s (%.12s)", l.Name, l.Path)
+	}
+	if l.PID != 0 {
+		s += fmt.Sprintf(" of pid %d", l.PID)
+	}
+	return s
+}
+
+// WriteMarker write the marker of the current process into dir, creating it if needed. ownsData tells the run
+// created dir, see Marker.OwnsData
+func WriteMarker(dir string, command string, ownsData bool) error {
+	marker := Marker{PID: os.Getpid(), Command: command, Created: time.Now(), OwnsData: ownsData}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(marker, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written aside then renamed, a crash never leaves a truncated marker behind
+	file, err := os.CreateTemp(dir, MARKER_FILE_NAME+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(bytes, '\n'))
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, MARKER_FILE_NAME))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// ReadMarker read the marker of dir, nil if it has none
+func ReadMarker(dir string) (*Marker, error) {
+	bytes, err := os.ReadFile(filepath.Join(dir, MARKER_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	marker := &Marker{}
+	err = json.Unmarshal(bytes, marker)
+	if err != nil {
+		return nil, fmt.Errorf("malformed marker %s: %s", filepath.Join(dir, MARKER_FILE_NAME), err.Error())
+	}
+	return marker, nil
+}
+
+// RemoveMarker remove the marker of dir, its content is kept
+func RemoveMarker(dir string) error {
+	err := os.Remove(filepath.Join(dir, MARKER_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// FindLeftovers return what the runs which are not running anymore left behind: the containers of rt carrying
+// OWNER_LABEL, and the staging dirs and the kept data dir of workDir with a marker. rt may be nil, or its binary
+// missing, then no container is looked for. a runtime failing to list the containers, such as one without a
+// reachable daemon, is logged and only the dirs are looked for. the dirs of other users, such as in a shared
+// /tmp, are left to them, and so are the dirs whose marker can't be read, which are logged
+func FindLeftovers(ctx context.Context, rt Runtime, workDir string) ([]Leftover, error) {
+	ret := make([]Leftover, 0)
+	if rt != nil {
+		if _, err := rt.Command(); err == nil {
+			containers, err := rt.ListContainers(ctx, OWNER_LABEL+"="+OWNER_LABEL_VALUE)
+			if err != nil {
+				log.Printf("warning: containers left behind are not looked for, %s failed: %s \n", rt.Name(), err.Error())
+			}
+			for _, container := range containers {
+				pid, _ := strconv.Atoi(container.Labels[PID_LABEL])
+				// the pid of another host can't be checked, its container may be in use still
+				if host := container.Labels[HOST_LABEL]; host != HOST_ID {
+					log.Printf("container %s was run by image-batch pid %d of host %q, remove it there if it's left behind \n",
+						container.Name, pid, host)
+					continue
+				}
+				if running(pid) {
+					continue
+				}
+				ret = append(ret, Leftover{Kind: LEFTOVER_CONTAINER, Path: container.ID, Name: container.Name, PID: pid})
+			}
+		}
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(workDir, STAGING_DIR_PREFIX+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() || !ownedByCurrentUser(info) {
+			continue
+		}
+		marker, err := ReadMarker(dir)
+		if err != nil {
+			log.Printf("warning: %s is skipped, remove it if it's left behind: %s \n", dir, err.Error())
+			continue
+		}
+		// a dir without marker is not known to be one of image-batch
+		if marker == nil || running(marker.PID) {
+			continue
+		}
+		if marker.OwnsData {
+			ret = append(ret, Leftover{Kind: LEFTOVER_DATA, Path: dir, PID: marker.PID})
+		} else {
+			ret = append(ret, Leftover{Kind: LEFTOVER_FILE, Path: filepath.Join(dir, MARKER_FILE_NAME), PID: marker.PID})
+		}
+	}
+	return ret, nil
+}
+
+// CheckNotInUse fail if dir has the marker of a running image-batch. a malformed marker is logged, it's not the
+// one of a running run as the markers are written whole
+func CheckNotInUse(dir string) error {
+	marker, err := ReadMarker(dir)
+	if err != nil {
+		log.Printf("warning: %s \n", err.Error())
+		return nil
+	}
+	if marker != nil && running(marker.PID) {
+		return fmt.Errorf("%s is in use by the %s of image-batch pid %d", dir, marker.Command, marker.PID)
+	}
+	return nil
+}
+
+// cleanupContext return the context of a command cleaning up after a run, bound by CLEANUP_TIMEOUT only
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), CLEANUP_TIMEOUT)
+}
+
+// hostID return the hostname and the machine id, or the boot id if there's none, of the host
+func hostID() string {
+	name, _ := os.Hostname()
+	for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id", "/proc/sys/kernel/random/boot_id"} {
+		if id, err := os.ReadFile(file); err == nil && strings.TrimSpace(string(id)) != "" {
+			return name + "/" + strings.TrimSpace(string(id))
+		}
+	}
+	return name
+}
+
+// running return true if pid is another image-batch process which is still running
+func running(pid int) bool {
+	return pid != 0 && pid != os.Getpid() && processAlive(pid)
+}
+
+// RemoveLeftovers remove the leftovers, the containers through rt. every leftover is tried
+func RemoveLeftovers(ctx context.Context, rt Runtime, leftovers []Leftover) error {
+	failed := make([]string, 0)
+	for _, leftover := range leftovers {
+		var err error
+		if leftover.Kind == LEFTOVER_CONTAINER {
+			var cmd []string
+			cmd, err = rt.Command("rm", "-f", leftover.Path)
+			if err == nil {
+				_, err = runCommand(ctx, cmd...)
+			}
+		} else {
+			err = os.RemoveAll(leftover.Path)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", leftover, err.Error()))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to remove %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Preflight remove what the crashed runs left behind before dump or load starts, see FindLeftovers.
+// a leftover which can't be removed is logged, it doesn't keep the run from starting
+func Preflight(ctx context.Context, rt Runtime, workDir string) error {
+	leftovers, err := FindLeftovers(ctx, rt, workDir)
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		log.Printf("removing %s left behind by a previous run \n", leftover)
+	}
+	err = RemoveLeftovers(ctx, rt, leftovers)
+	if err != nil {
+		log.Printf("warning: %s, run image-batch cleanup to retry \n", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+// writeFakeDocker write a docker into dir listing a container left behind by a dead run, one of a running run,
+// one run from another host sharing the daemon, running the registry container published on port 49153, and logging its args into dir/docker.log
+func writeFakeDocker(t *testing.T, dir string) {
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s/docker.log
+case "$1" in
+ps)
+  echo dead0000
+  echo live0000
+  echo away0000
+  ;;
+container)
+  case "$5" in
+  dead0000) printf 'dead0000\t/registry\t{"%[2]s":"%[3]s","%[4]s":"999999","%[6]s":"%[7]s"}\n' ;;
+  live0000) printf 'live0000\t/registry-2\t{"%[2]s":"%[3]s","%[4]s":"%[5]d","%[6]s":"%[7]s"}\n' ;;
+  away0000) printf 'away0000\t/registry-3\t{"%[2]s":"%[3]s","%[4]s":"999999","%[6]s":"ci-runner-2/0123"}\n' ;;
+  other) printf 'other\t/other\tnull\n' ;;
+  *) echo "Error: No such container: $5" >&2; exit 1 ;;
+  esac
+  ;;
+image) echo 0123456789ab ;;
+run) echo run0000 ;;
+port) printf '0.0.0.0:49153\n[::]:49153\n' ;;
+esac
+`, dir, OWNER_LABEL, OWNER_LABEL_VALUE, PID_LABEL, os.Getppid(), HOST_LABEL, HOST_ID)
+	err := os.WriteFile(paths.Join(dir, "docker"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestCliRuntime_Containers(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDocker(t, dir)
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	rt := cliRuntime{name: RUNTIME_DOCKER}
+
+	containers, err := rt.ListContainers(context.Background(), OWNER_LABEL+"="+OWNER_LABEL_VALUE)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(containers) != 3 || containers[0].Name != "registry" || containers[0].Labels[PID_LABEL] != "999999" {
+		t.Errorf("unexpected containers %+v", containers)
+	}
+	container, err := rt.InspectContainer(context.Background(), "missing")
+	if err != nil || container != nil {
+		t.Errorf("a missing container should be nil, got %+v %v", container, err)
+	}
+	container, err = rt.InspectContainer(context.Background(), "other")
+	if err != nil || container == nil || container.Labels[OWNER_LABEL] != "" {
+		t.Errorf("a container without labels should be found, got %+v %v", container, err)
+	}
+}
+
+func TestRegistry_StartPublished(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDocker(t, dir)
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	reg := NewDefaultRegistry(append(NewDefaultOptions(), WithRuntime(cliRuntime{name: RUNTIME_DOCKER}))...)
+	err := reg.Start(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reg.Endpoint() != "127.0.0.1:49153" {
+		t.Errorf("the registry should be published on the port chosen by the runtime, got %s", reg.Endpoint())
+	}
+	log, _ := os.ReadFile(paths.Join(dir, "docker.log"))
+	name := fmt.Sprintf("--name %s%d ", CONTAINER_NAME_PREFIX, os.Getpid())
+	if !strings.Contains(string(log), "-p 127.0.0.1::5000 ") || !strings.Contains(string(log), name) {
+		t.Errorf("the registry should run on a free loopback port under a unique name, got %s", log)
+	}
+	if !strings.Contains(string(log), "--label "+HOST_LABEL+"="+HOST_ID+" ") {
+		t.Errorf("the registry should be labeled with the host it's run from, got %s", log)
+	}
+	if !strings.Contains(string(log), "port run0000 5000/tcp") {
+		t.Errorf("the published port should be asked for, got %s", log)
+	}
+
+	err = reg.Stop()
+	if err != nil || reg.Endpoint() != "" {
+		t.Errorf("the endpoint should be reset once stopped, got %s %v", reg.Endpoint(), err)
+	}
+}
+
+func TestFindLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	writeFakeDocker(t, dir)
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	rt := cliRuntime{name: RUNTIME_DOCKER}
+	workDir := paths.Join(dir, "work")
+
+	// no staging dir yet, and dirs without marker such as the auth dirs are not image-batch's to remove
+	os.MkdirAll(paths.Join(workDir, STAGING_DIR_PREFIX+"auth-1"), 0755)
+	leftovers, err := FindLeftovers(context.Background(), rt, workDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(leftovers) != 1 || leftovers[0].Kind != LEFTOVER_CONTAINER || leftovers[0].Name != "registry" || leftovers[0].PID != 999999 {
+		t.Fatalf("only the container of the dead run should be found, got %v", leftovers)
+	}
+
+	// staging dirs of a dead run and of a running run
+	dead := paths.Join(workDir, STAGING_DIR_PREFIX+"dead")
+	err = WriteMarker(dead, "dump", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	marker, _ := ReadMarker(dead)
+	if marker == nil || !marker.OwnsData || marker.PID != os.Getpid() || marker.Command != "dump" {
+		t.Fatalf("unexpected marker %+v", marker)
+	}
+	marker.PID = 999999
+	writeMarker(t, dead, marker)
+	live := paths.Join(workDir, STAGING_DIR_PREFIX+"live")
+	os.MkdirAll(live, 0755)
+	writeMarker(t, live, &Marker{PID: os.Getppid(), Command: "load", OwnsData: true})
+	if err := CheckNotInUse(live); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("the staging dir of a running run should be in use, got %v", err)
+	}
+	if err := CheckNotInUse(dead); err != nil {
+		t.Errorf("the staging dir of a dead run should not be in use, got %v", err)
+	}
+
+	// the data kept by a previous load, marked by a load which died
+	kept := paths.Join(workDir, KEPT_DATA_DIR_NAME)
+	os.MkdirAll(paths.Join(kept, "docker"), 0755)
+	writeMarker(t, kept, &Marker{PID: 999999, Command: "load"})
+
+	leftovers, err = FindLeftovers(context.Background(), rt, workDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(leftovers) != 3 || leftovers[1].Kind != LEFTOVER_FILE || leftovers[1].Path != paths.Join(kept, MARKER_FILE_NAME) ||
+		leftovers[2].Kind != LEFTOVER_DATA || leftovers[2].Path != dead {
+		t.Fatalf("the staging dir and the marker of the kept data should be found, got %v", leftovers)
+	}
+	err = RemoveLeftovers(context.Background(), rt, leftovers)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(dead); err == nil {
+		t.Error("the staging dir of the dead run should be removed")
+	}
+	for _, left := range []string{live, paths.Join(kept, "docker"), paths.Join(workDir, STAGING_DIR_PREFIX+"auth-1")} {
+		if _, err := os.Stat(left); err != nil {
+			t.Errorf("%s should be left alone", left)
+		}
+	}
+	if marker, _ := ReadMarker(kept); marker != nil {
+		t.Error("the marker of the kept data should be removed")
+	}
+	log, _ := os.ReadFile(paths.Join(dir, "docker.log"))
+	if !strings.Contains(string(log), "rm -f dead0000") || strings.Contains(string(log), "rm -f live0000") {
+		t.Errorf("only the container of the dead run should be removed, got %s", log)
+	}
+	if strings.Contains(string(log), "rm -f away0000") {
+		t.Errorf("the container of another host should be left alone, its pid can't be checked here, got %s", log)
+	}
+}
+
+func TestRegistry_StageLeftover(t *testing.T) {
+	workDir := t.TempDir()
+	reg := &registry{options: &Options{WorkDir: workDir}}
+	err := reg.stage("dump")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.MkdirAll(reg.options.DataPath, 0755)
+
+	// the run crashes: its staging dir, data included, is the leftover and not only its marker
+	leftovers, err := FindLeftovers(context.Background(), nil, workDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(leftovers) != 1 || leftovers[0].Kind != LEFTOVER_DATA || leftovers[0].Path != reg.staging {
+		t.Fatalf("the staging dir should be found, got %v", leftovers)
+	}
+	err = RemoveLeftovers(context.Background(), nil, leftovers)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(reg.staging); err == nil {
+		t.Error("the staging dir should be removed with its data")
+	}
+}
+
+func TestFindLeftovers_TruncatedMarker(t *testing.T) {
+	workDir := t.TempDir()
+	broken := paths.Join(workDir, STAGING_DIR_PREFIX+"broken")
+	os.MkdirAll(broken, 0755)
+	os.WriteFile(paths.Join(broken, MARKER_FILE_NAME), []byte(`{"pid":999999,"comm`), 0644)
+	dead := paths.Join(workDir, STAGING_DIR_PREFIX+"dead")
+	os.MkdirAll(dead, 0755)
+	writeMarker(t, dead, &Marker{PID: 999999, Command: "dump", OwnsData: true})
+
+	// the dir of the truncated marker is skipped, the other leftovers are still found
+	leftovers, err := FindLeftovers(context.Background(), nil, workDir)
+	if err != nil {
+		t.Fatalf("a truncated marker shouldn't keep the run from starting, got %s", err.Error())
+	}
+	if len(leftovers) != 1 || leftovers[0].Path != dead {
+		t.Errorf("only the staging dir of the dead run should be found, got %v", leftovers)
+	}
+	if err := CheckNotInUse(broken); err != nil {
+		t.Errorf("a truncated marker is not the one of a running run, got %s", err.Error())
+	}
+
+	// a marker is replaced whole, with no temp file left aside
+	err = WriteMarker(broken, "load", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if marker, err := ReadMarker(broken); err != nil || marker == nil || marker.Command != "load" {
+		t.Errorf("the marker should be rewritten, got %+v %v", marker, err)
+	}
+	if entries, _ := os.ReadDir(broken); len(entries) != 1 {
+		t.Errorf("only the marker should be written, got %v", entries)
+	}
+}
+
+// unreachableRuntime is a runtime whose binary is present but whose daemon can't be reached
+type unreachableRuntime struct {
+	cliRuntime
+}
+
+func (unreachableRuntime) Command(args ...string) ([]string, error) {
+	return append([]string{"docker"}, args...), nil
+}
+
+func (unreachableRuntime) ListContainers(ctx context.Context, label string) ([]Container, error) {
+	return nil, errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock")
+}
+
+func TestFindLeftovers_Unreachable(t *testing.T) {
+	workDir := t.TempDir()
+	dead := paths.Join(workDir, STAGING_DIR_PREFIX+"dead")
+	os.MkdirAll(dead, 0755)
+	writeMarker(t, dead, &Marker{PID: 999999, Command: "dump", OwnsData: true})
+
+	// the dirs are still looked for, the daemon isn't needed by the native dump nor load --to
+	leftovers, err := FindLeftovers(context.Background(), unreachableRuntime{cliRuntime{name: RUNTIME_DOCKER}}, workDir)
+	if err != nil {
+		t.Fatalf("an unreachable daemon should only be warned about, got %s", err.Error())
+	}
+	if len(leftovers) != 1 || leftovers[0].Path != dead {
+		t.Errorf("the staging dir of the dead run should be found, got %v", leftovers)
+	}
+}
+
+// stuckRuntime lists a container left behind by a dead run, which can't be removed
+type stuckRuntime struct {
+	unreachableRuntime
+}
+
+func (stuckRuntime) ListContainers(ctx context.Context, label string) ([]Container, error) {
+	return []Container{{ID: "dead0000", Name: "registry", Labels: map[string]string{PID_LABEL: "999999"}}}, nil
+}
+
+func TestPreflight(t *testing.T) {
+	// the docker of the runtime is missing, the container can't be removed
+	t.Setenv("PATH", t.TempDir())
+	workDir := t.TempDir()
+	dead := paths.Join(workDir, STAGING_DIR_PREFIX+"dead")
+	os.MkdirAll(dead, 0755)
+	writeMarker(t, dead, &Marker{PID: 999999, Command: "dump", OwnsData: true})
+
+	err := Preflight(context.Background(), stuckRuntime{unreachableRuntime{cliRuntime{name: RUNTIME_DOCKER}}}, workDir)
+	if err != nil {
+		t.Fatalf("a leftover which can't be removed shouldn't keep the run from starting, got %s", err.Error())
+	}
+	if _, err := os.Stat(dead); err == nil {
+		t.Error("the leftovers which can be removed should be removed still")
+	}
+	if err := RemoveLeftovers(context.Background(), stuckRuntime{}, []Leftover{{Kind: LEFTOVER_CONTAINER, Path: "dead0000"}}); err == nil {
+		t.Error("cleanup should fail on a leftover which can't be removed")
+	}
+
+	// the dir of another user, such as in a shared /tmp, is left to its owner
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of a dir requires root")
+	}
+	other := paths.Join(workDir, STAGING_DIR_PREFIX+"other")
+	os.MkdirAll(other, 0755)
+	writeMarker(t, other, &Marker{PID: 999999, Command: "load", OwnsData: true})
+	err = os.Chown(other, 4242, 4242)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leftovers, err := FindLeftovers(context.Background(), nil, workDir)
+	if err != nil || len(leftovers) != 0 {
+		t.Errorf("the dir of another user should be skipped, got %v %v", leftovers, err)
+	}
+}
+
+func writeMarker(t *testing.T, dataPath string, marker *Marker) {
+	bytes, _ := json.Marshal(marker)
+	err := os.WriteFile(paths.Join(dataPath, MARKER_FILE_NAME), bytes, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -0,0 +1,508 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// this section implements a client of the Registry HTTP API v2, which fetch images
+// straight from the remote registry without a docker daemon
+
+var (
+	// DOCKER_HUB_HOST is the canonical name of docker hub in image references
+	DOCKER_HUB_HOST = "docker.io"
+
+	// DOCKER_HUB_ENDPOINT is the host actually serving the docker hub API
+	DOCKER_HUB_ENDPOINT = "registry-1.docker.io"
+
+	// MAX_MANIFEST_SIZE guard against reading a huge body as manifest
+	MAX_MANIFEST_SIZE int64 = 4 << 20
+)
+
+// CredentialFunc return the username and password of a registry host,
+// empty username means anonymous access
+type CredentialFunc func(host string) (string, string, error)
+
+// Client is a Registry HTTP API v2 client, it's safe for concurrent use
+type Client struct {
+	// HTTP is the underlying http client
+	HTTP *http.Client
+
+	// Insecure allow plain http and skip tls verification for every host.
+	// loopback hosts are always spoken to over plain http
+	Insecure bool
+
+	// Credentials is used to answer basic and token auth challenges
+	Credentials CredentialFunc
+
+	lock sync.Mutex
+	// bearer tokens by host and scope
+	tokens map[string]string
+	// hosts fallen back to plain http
+	plain map[string]bool
+}
+
+// StatusError is returned when the registry answer with an unexpected status
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: unexpected status %d %s", e.Method, e.URL, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// GetManifest fetch the manifest of repo by tag or digest,
+// return the raw body, its media type and digest
+func (c *Client) GetManifest(ctx context.Context, host string, repo string, ref string) ([]byte, string, string, error) {
+	resp, err := c.do(ctx, host, repo, "pull", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(host, "/v2/"+repo+"/manifests/"+ref), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(ManifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", newStatusError(resp)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_MANIFEST_SIZE))
+	if err != nil {
+		return nil, "", "", err
+	}
+	digest := Digest(body)
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return nil, "", "", fmt.Errorf("manifest %s@%s: digest mismatch, got %s", repo, ref, digest)
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	return body, mediaType, digest, nil
+}
+
+// GetBlob open the blob of repo by its digest, the caller must close the reader
+func (c *Client) GetBlob(ctx context.Context, host string, repo string, digest string) (io.ReadCloser, int64, error) {
+	resp, err := c.do(ctx, host, repo, "pull", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.url(host, "/v2/"+repo+"/blobs/"+digest), nil)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, newStatusError(resp)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// BlobExists return true if the blob is present in repo
+func (c *Client) BlobExists(ctx context.Context, host string, repo string, digest string) (bool, error) {
+	resp, err := c.do(ctx, host, repo, "pull,push", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, c.url(host, "/v2/"+repo+"/blobs/"+digest), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, newStatusError(resp)
+	}
+}
+
+// UploadBlob upload the blob of size in a single request, open is called for each attempt
+func (c *Client) UploadBlob(ctx context.Context, host string, repo string, digest string, size int64, open func() (io.ReadCloser, error)) error {
+	resp, err := c.do(ctx, host, repo, "pull,push", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, c.url(host, "/v2/"+repo+"/blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return newStatusError(resp)
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	resp, err = c.do(ctx, host, repo, "pull,push", func() (*http.Request, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+// PutManifest push the manifest body to repo by tag or digest
+func (c *Client) PutManifest(ctx context.Context, host string, repo string, ref string, mediaType string, body []byte) error {
+	resp, err := c.do(ctx, host, repo, "pull,push", func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(host, "/v2/"+repo+"/manifests/"+ref), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+// ListTags return every tag of repo, following the pagination of the registry
+func (c *Client) ListTags(ctx context.Context, host string, repo string) ([]string, error) {
+	ret := make([]string, 0)
+	err := c.getPages(ctx, host, fmt.Sprintf("repository:%s:pull", repo), "/v2/"+repo+"/tags/list", func(body []byte) error {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err := json.Unmarshal(body, &page)
+		ret = append(ret, page.Tags...)
+		return err
+	})
+	return ret, err
+}
+
+// Catalog return every repository of host, following the pagination of the registry.
+// registries may refuse to list their repositories, such as docker hub
+func (c *Client) Catalog(ctx context.Context, host string) ([]string, error) {
+	ret := make([]string, 0)
+	err := c.getPages(ctx, host, "registry:catalog:*", "/v2/_catalog", func(body []byte) error {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err := json.Unmarshal(body, &page)
+		ret = append(ret, page.Repositories...)
+		return err
+	})
+	return ret, err
+}
+
+// getPages get path and the next pages named by the Link header, calling page with each body
+func (c *Client) getPages(ctx context.Context, host string, scope string, path string, page func(body []byte) error) error {
+	for next := ""; ; {
+		var u string
+		resp, err := c.doScope(ctx, host, scope, func() (*http.Request, error) {
+			// the first page is built per attempt, as the scheme may fall back to plain http
+			u = next
+			if u == "" {
+				u = c.url(host, path)
+			}
+			return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return newStatusError(resp)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_MANIFEST_SIZE))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		err = page(body)
+		if err != nil {
+			return fmt.Errorf("GET %s: %s", u, err.Error())
+		}
+		if next = nextPage(resp); next == "" {
+			return nil
+		}
+	}
+}
+
+// nextPage return the url of the Link header `<url>; rel="next"` resolved against the request, empty if none
+func nextPage(resp *http.Response) string {
+	for _, link := range resp.Header.Values("Link") {
+		target, params, _ := strings.Cut(link, ";")
+		if !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+			continue
+		}
+		u, err := resp.Request.URL.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return ""
+		}
+		return u.String()
+	}
+	return ""
+}
+
+// do send the request built by newRequest with the scope of repo, see doScope
+func (c *Client) do(ctx context.Context, host string, repo string, actions string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	return c.doScope(ctx, host, fmt.Sprintf("repository:%s:%s", repo, actions), newRequest)
+}
+
+// doScope send the request built by newRequest, answering an auth challenge for scope at most once
+func (c *Client) doScope(ctx context.Context, host string, scope string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if token := c.token(host, scope); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		return c.httpClient().Do(req)
+	}
+	resp, err := send()
+	if err != nil && c.Insecure && !c.isPlain(host) {
+		// retry over plain http
+		c.lock.Lock()
+		if c.plain == nil {
+			c.plain = make(map[string]bool)
+		}
+		c.plain[host] = true
+		c.lock.Unlock()
+		resp, err = send()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	err = c.authorize(ctx, host, scope, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// authorize answer the WWW-Authenticate challenge and remember the result for the scope
+func (c *Client) authorize(ctx context.Context, host string, scope string, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	username, password, err := c.credentials(host)
+	if err != nil {
+		return err
+	}
+	var token string
+	switch scheme {
+	case "basic":
+		if username == "" {
+			return fmt.Errorf("registry %s requires authentication", host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(username, password)
+		token = req.Header.Get("Authorization")
+	case "bearer":
+		token, err = c.fetchToken(ctx, params, scope, username, password)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("registry %s: unsupported auth challenge %q", host, challenge)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[host+" "+scope] = token
+	return nil
+}
+
+// fetchToken request a bearer token from the auth server named by the challenge
+func (c *Client) fetchToken(ctx context.Context, params map[string]string, scope string, username string, password string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	var req *http.Request
+	if username == IDENTITY_TOKEN_USERNAME {
+		// an identity token is exchanged for an access token by the oauth2 refresh flow
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", password)
+		q.Set("client_id", "image-batch")
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(q.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	var ret struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ret)
+	if err != nil {
+		return "", err
+	}
+	if ret.Token == "" {
+		ret.Token = ret.AccessToken
+	}
+	if ret.Token == "" {
+		return "", fmt.Errorf("auth server %s returned no token", realm)
+	}
+	return "Bearer " + ret.Token, nil
+}
+
+// parseChallenge parse `Bearer realm="...",service="..."` into its lower-cased scheme and params
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			params[key] = value
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+func (c *Client) token(host string, scope string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.tokens[host+" "+scope]
+}
+
+func (c *Client) credentials(host string) (string, string, error) {
+	if c.Credentials == nil {
+		return "", "", nil
+	}
+	return c.Credentials(host)
+}
+
+func (c *Client) isPlain(host string) bool {
+	if isLoopbackHost(host) {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.plain[host]
+}
+
+// url build the API url of host, docker hub is served by another host than its name
+func (c *Client) url(host string, path string) string {
+	scheme := "https"
+	if c.isPlain(host) {
+		scheme = "http"
+	}
+	if host == DOCKER_HUB_HOST {
+		host = DOCKER_HUB_ENDPOINT
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// isLoopbackHost return true for localhost and 127.0.0.0/8 with or without a port
+func isLoopbackHost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+func newStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+}
+
+// NewDefaultClient return a client verifying tls, with anonymous access
+func NewDefaultClient() *Client {
+	return &Client{
+		HTTP: &http.Client{},
+	}
+}
+
+// NewInsecureClient return a client allowing plain http and skipping tls verification
+func NewInsecureClient() *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &Client{
+		HTTP:     &http.Client{Transport: transport},
+		Insecure: true,
+	}
+}
@@ -1,150 +1,84 @@
 package registry
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"os/exec"
-	paths "path"
 	"strings"
 )
 
-// simplify cmd.go exc
-
-
-func BashCommandExec(args... string) (string,error){
-	cmdRun:=exec.Command("/bin/bash","-c",strings.Join(args," "))
-	output,err:=cmdRun.CombinedOutput()
-	if err != nil {
-		return "",fmt.Errorf("exit msg: %s, "+ string(output), err.Error())
-	}
-	return string(output), nil
-}
-// ExecAndSignal useful in async task, this function put finished indicates finish. put error into e
-func ExecAndSignal(cmd []string,finished chan struct{},e chan error){
-	output,err:= BashCommandExec(cmd...)
-	if err != nil {
-		finished<- struct{}{}
-		e<-err
-		return
-	}
-	log.Printf("%s done \n",strings.Join(cmd," "))
-	log.Println(output)
-	finished<- struct{}{}
-	e<-nil
-}
-
-func DockerCmd(args... string) ([]string,error){
-	path,err:=FindBestBinary("")
-	if err != nil {
-		return []string{},err
-	}
-	cmd:=[]string{path}
-	cmd=append(cmd,args...)
-	return cmd,nil
-}
-
-
-
-
-func ErrorWithStderr(output string,err error) error{
-	return fmt.Errorf("exit msg: %s, "+ string(output), err.Error())
-}
-
-// ParseImagesFromFile parse image from file, with one remote image one line
+// ParseImagesFromFile parse image from file, with one remote image one line, or a structured list,
+// see ParseImageList. every image must be a well-formed reference, see ParseReference
 func ParseImagesFromFile(path string) ([]string,error){
-	// pull the image from running registry
-	content,err:=os.ReadFile(path)
+	entries,err:=ParseImageList(path)
 	if err != nil {
 		return []string{},err
 	}
-	strContent:=string(content)
-	list:=strings.Split(strContent,"\n")
-
-	ret:=make([]string,0)
-	for _, e := range list {
-		if strings.TrimSpace(e) == "" {
-			continue
-		}
-		ret=append(ret,strings.TrimSpace(e))
+	ret:=make([]string,0,len(entries))
+	for _,entry:=range entries{
+		ret=append(ret,entry.Reference)
 	}
-	fmt.Println(strings.Join(ret,","))
 	return ret,nil
 }
 
-// TransformImageTag transform image tag from registry.xx.com/repo/artifact:tag => localhost:5000/artifact:tag
+// TransformImageTag transform image tag from registry.xx.com/repo/artifact:tag => localhost:5000/registry.xx.com/repo/artifact:tag,
+// see LocalTag. the host is rebased onto the endpoint of the registry instance by dump, see RebaseImage.
+// it refuses images which would be stored under the same local tag
 func TransformImageTag(images []string) (map[string]string,error){
-	localReg:="localhost:5000/"
 	ret:=make(map[string]string)
+	owners:=make(map[string]string)
 	for _,image:=range images{
-		tmpList:=strings.Split(image,"/")
-		baseRaw:=tmpList[len(tmpList)-1]
-		base:=strings.TrimSpace(baseRaw)
-		if base == ""{
-			return map[string]string{},fmt.Errorf("wrong image format %s",image)
+		local,err:=LocalTag(image)
+		if err != nil {
+			return map[string]string{},err
+		}
+		// the same image written twice, such as nginx and docker.io/library/nginx:latest, is no collision
+		ref,_:=ParseReference(image)
+		ref.Domain=strings.ToLower(ref.Domain)
+		if ref.Digest != "" {
+			// the tag doesn't matter once pinned to a digest
+			ref.Tag=""
+		}
+		normalized:=ref.String()
+		if owner,ok:=owners[local];ok && owner != normalized {
+			return map[string]string{},fmt.Errorf("images %s and %s collide on local tag %s",owner,normalized,local)
 		}
-		//such as localhost:5000/example:v2
-		base=localReg+base
-		ret[image]=base
+		owners[local]=normalized
+		ret[image]=local
 	}
 	return ret,nil
 }
 
 
-func RetagOne(kv string) error{
-	cmd,err:=DockerCmd("tag",kv)
-	if err != nil {
-		return err
-	}
-	output,err:=BashCommandExec(cmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
-	fmt.Printf("%s \n",strings.Join(cmd," "))
-	return nil
-}
-
-// LoadRegistryV2DockerImage load registry:2 docker offline images
-func LoadRegistryV2DockerImage(path string) error{
-	loadCmd, _ :=DockerCmd("load","-i",path)
-	output,err:=BashCommandExec(loadCmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
+// RebaseImage replace the registry host of a local tag, such as localhost:5000/busybox:v1 => 127.0.0.1:39017/busybox:v1
+func RebaseImage(image string,host string) string{
+	i:=strings.Index(image,"/")
+	if i < 0 {
+		return host+"/"+image
 	}
-	return nil
-}
-// SaveRegistryV2DockerImage docker save registry:2 > ${path}/registry.tar
-func SaveRegistryV2DockerImage(path string) error{
-	log.Printf("docker save registry:2 > %s/registry.tar \n", path)
-	cmd, err := DockerCmd("save", "registry:2", ">", paths.Join(path,OFFLINE_IMAGE_NAME_OF_REGISTRY_V2))
-	if err != nil {
-		return err
-	}
-	output,err:=BashCommandExec(cmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
-	return nil
+	return host+image[i:]
 }
 
 
 
-// TarExtractFrom extract tar.gz from specified target to current dir
-func TarExtractFrom(target string) error{
-	cmd:=[]string{"tar","--strip-components=2","-xzf",target}
-	output,err:=BashCommandExec(cmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
-	return nil
+// TarExtractFrom extract tar.gz from specified target to dir, without the 2 levels of dirs of the entries
+func TarExtractFrom(ctx context.Context,target string,dir string) error{
+	cmd:=[]string{"tar","--strip-components=2","-xzf",target,"-C",dir}
+	_,err:=runCommand(ctx,cmd...)
+	return err
 }
 // TarCompressTo compress `source` into dst, in tar.gz format
-func TarCompressTo(dst string, source string) error{
+func TarCompressTo(ctx context.Context,dst string, source string) error{
 	log.Printf("compressing the dump files in a whole piece from %s to: %s \n",source,dst)
 	cmd2:=[]string{"tar","czf",dst,source}
-	output,err:=BashCommandExec(cmd2...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
-	return nil
+	_,err:=runCommand(ctx,cmd2...)
+	return err
+}
+// TarCompressDirTo compress the entries of dir into dst, in tar.gz format with the entries at the root
+func TarCompressDirTo(ctx context.Context,dst string, dir string, entries... string) error{
+	log.Printf("compressing %s from %s to: %s \n",strings.Join(entries,","),dir,dst)
+	cmd:=[]string{"tar","czf",dst,"-C",dir}
+	cmd=append(cmd,entries...)
+	_,err:=runCommand(ctx,cmd...)
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,246 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// this section collects the images of the services of docker-compose files, with the variables
+// of the compose file interpolated from the environment and the env file, as docker compose does
+
+var (
+	// COMPOSE_ENV_FILE_NAME is the env file read next to a compose file unless another one is given
+	COMPOSE_ENV_FILE_NAME = ".env"
+)
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image string      `yaml:"image"`
+	Build interface{} `yaml:"build"`
+}
+
+// ParseImagesFromCompose return the images of the services of the compose file at path, sorted, without duplicates,
+// and a warning for every service which has no image to pull. the variables are looked up in the environment
+// first, then in envFile, or in the COMPOSE_ENV_FILE_NAME next to path if envFile is empty
+func ParseImagesFromCompose(path string, envFile string) ([]string, []string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	env := make(map[string]string)
+	if envFile == "" {
+		envFile = filepath.Join(filepath.Dir(path), COMPOSE_ENV_FILE_NAME)
+		if _, err := os.Stat(envFile); err != nil {
+			envFile = ""
+		}
+	}
+	if envFile != "" {
+		env, err = ParseEnvFile(envFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	lookup := func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := env[name]
+		return value, ok
+	}
+
+	compose := composeFile{}
+	err = yaml.Unmarshal(content, &compose)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compose file %s: %s", path, err.Error())
+	}
+	names := make([]string, 0, len(compose.Services))
+	for name := range compose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]bool)
+	warnings := make([]string, 0)
+	for _, name := range names {
+		service := compose.Services[name]
+		image, err := Interpolate(service.Image, lookup)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compose file %s: service %s: %s", path, name, err.Error())
+		}
+		image = strings.TrimSpace(image)
+		if image == "" {
+			if service.Build != nil {
+				warnings = append(warnings, fmt.Sprintf("compose file %s: service %s is built, not pulled, it's left out", path, name))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("compose file %s: service %s has no image, it's left out", path, name))
+			}
+			continue
+		}
+		if _, err := ParseReference(image); err != nil {
+			return nil, nil, fmt.Errorf("compose file %s: service %s: %s", path, name, err.Error())
+		}
+		seen[image] = true
+	}
+	ret := make([]string, 0, len(seen))
+	for image := range seen {
+		ret = append(ret, image)
+	}
+	sort.Strings(ret)
+	return ret, warnings, nil
+}
+
+// ParseEnvFile parse the KEY=VALUE lines of an env file. blank lines and comments are skipped,
+// an optional `export ` prefix and the quotes around a value are dropped
+func ParseEnvFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("env file %s line %d: expected KEY=VALUE", path, i)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		} else if j := strings.Index(value, " #"); j >= 0 {
+			value = strings.TrimSpace(value[:j])
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+// Interpolate replace the variables of s as docker compose does: $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error}, ${VAR?error}, ${VAR:+replacement} and ${VAR+replacement}. `$$` is a literal `$`.
+// the default, error and replacement are interpolated as well
+func Interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			b.WriteByte('$')
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("unclosed variable in %q", s)
+			}
+			value, err := expandVariable(s[i+2:end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		case isVariableChar(next, true):
+			j := i + 1
+			for j < len(s) && isVariableChar(s[j], j == i+1) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			b.WriteString(value)
+			i = j - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// expandVariable expand the body of ${...}
+func expandVariable(body string, lookup func(string) (string, bool)) (string, error) {
+	j := 0
+	for j < len(body) && isVariableChar(body[j], j == 0) {
+		j++
+	}
+	name, rest := body[:j], body[j:]
+	if name == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", body)
+	}
+	value, set := lookup(name)
+	if rest == "" {
+		return value, nil
+	}
+	colon := strings.HasPrefix(rest, ":")
+	if colon {
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", body)
+	}
+	// with a colon an empty variable counts as unset
+	present := set && (!colon || value != "")
+	operand, err := Interpolate(rest[1:], lookup)
+	if err != nil {
+		return "", err
+	}
+	switch rest[0] {
+	case '-':
+		if !present {
+			return operand, nil
+		}
+		return value, nil
+	case '?':
+		if !present {
+			if operand == "" {
+				operand = "required variable " + name + " is missing a value"
+			}
+			return "", fmt.Errorf("%s", operand)
+		}
+		return value, nil
+	case '+':
+		if present {
+			return operand, nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid variable ${%s}", body)
+}
+
+// closingBrace return the index of the brace closing the variable starting at start, -1 if none
+func closingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isVariableChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"TAG": "1.25", "EMPTY": "", "REGISTRY": "registry.internal"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	cases := map[string]string{
+		"nginx:$TAG":                          "nginx:1.25",
+		"nginx:${TAG}":                        "nginx:1.25",
+		"nginx:${MISSING:-1.24}":              "nginx:1.24",
+		"nginx:${EMPTY:-1.24}":                "nginx:1.24",
+		"nginx:${EMPTY-1.24}":                 "nginx:",
+		"${REGISTRY:+${REGISTRY}/}app:v1":     "registry.internal/app:v1",
+		"${MISSING:+${MISSING}/}app:v1":       "app:v1",
+		"app:${MISSING:-${TAG:-latest}}":      "app:1.25",
+		"cost$$":                              "cost$",
+		"${TAG:?the tag is required}-slim":    "1.25-slim",
+		"registry.internal/$REGISTRY_MISSING": "registry.internal/",
+	}
+	for s, want := range cases {
+		got, err := Interpolate(s, lookup)
+		if err != nil {
+			t.Errorf("%s: %s", s, err.Error())
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", s, got, want)
+		}
+	}
+	for s, want := range map[string]string{"${MISSING:?the tag is required}": "the tag is required", "${EMPTY:?}": "EMPTY", "${TAG": "unclosed"} {
+		if _, err := Interpolate(s, lookup); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error containing %q", s, err, want)
+		}
+	}
+}
+
+func TestParseImagesFromCompose(t *testing.T) {
+	dir := t.TempDir()
+	writeImageList(t, dir, ".env", "# versions\nexport TAG=1.25\nDB_TAG=\"16\"\nREGISTRY=registry.internal # mirror\n")
+	file := writeImageList(t, dir, "docker-compose.yml", `
+services:
+  web:
+    image: nginx:${TAG:-latest}
+  db:
+    image: postgres:${DB_TAG}
+  cache:
+    image: ${REGISTRY}/redis:7
+  app:
+    build: ./app
+  worker:
+    build:
+      context: ./app
+    image: ${REGISTRY}/app:${APP_TAG:-dev}
+  proxy:
+    image: nginx:${TAG:-latest}
+`)
+	images, warnings, err := ParseImagesFromCompose(file, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := []string{"nginx:1.25", "postgres:16", "registry.internal/app:dev", "registry.internal/redis:7"}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("got %v, want %v", images, want)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "service app is built") {
+		t.Errorf("the build only service should be warned about, got %v", warnings)
+	}
+
+	env := writeImageList(t, t.TempDir(), "prod.env", "TAG=1.24\nREGISTRY=mirror.internal\n")
+	t.Setenv("DB_TAG", "15")
+	images, _, err = ParseImagesFromCompose(file, env)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want = []string{"mirror.internal/app:dev", "mirror.internal/redis:7", "nginx:1.24", "postgres:15"}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("the env file and the environment should be used, got %v", images)
+	}
+
+	file = writeImageList(t, dir, "broken.yml", "services:\n  web:\n    image: ${MISSING:?set MISSING}\n")
+	if _, _, err := ParseImagesFromCompose(file, ""); err == nil || !strings.Contains(err.Error(), "set MISSING") {
+		t.Errorf("a required variable should be reported, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// this section copies the images of a registry data dir into a target registry,
+// which replaces the docker pull => docker tag round-trip of load
+
+// RegistryCopier push the images of Storage into the registry Host, under Prefix
+type RegistryCopier struct {
+	// Client talks to the target registry
+	Client *Client
+
+	// Storage holds the images to copy
+	Storage *Storage
+
+	// Host of the target registry, such as registry.internal:5000
+	Host string
+
+	// Prefix is prepended to every repository, such as `offline` in registry.internal:5000/offline
+	Prefix string
+
+	// Parallelism indicates the number of go routine,default to the number of cpu core
+	Parallelism int
+
+	// FailFast stop copying once an image failed, see runBatch
+	FailFast bool
+
+	// Retry is how the copies failing transiently, such as on a 502 of the registry, are retried
+	Retry RetryPolicy
+}
+
+// ParseTarget split registry.internal:5000[/prefix] into the registry host and repository prefix
+func ParseTarget(target string) (string, string, error) {
+	target = strings.Trim(strings.TrimSpace(target), "/")
+	target = strings.TrimPrefix(strings.TrimPrefix(target, "https://"), "http://")
+	host, prefix, _ := strings.Cut(target, "/")
+	if host == "" {
+		return "", "", fmt.Errorf("target registry can't be empty")
+	}
+	return host, prefix, nil
+}
+
+// TargetRepository return the repository image is pushed to, its original repository under Prefix
+func (c *RegistryCopier) TargetRepository(image string) string {
+	_, repo, _ := splitRemoteImage(image)
+	if c.Prefix == "" {
+		return repo
+	}
+	return c.Prefix + "/" + repo
+}
+
+// Copy push the manifest tagged as localTag and its blobs to the target registry, named after image
+func (c *RegistryCopier) Copy(ctx context.Context, image string, localTag string) error {
+	_, localRepo, localRef := splitRemoteImage(localTag)
+	_, _, ref := splitRemoteImage(image)
+	repo := c.TargetRepository(image)
+
+	digest, err := c.Storage.ResolveTag(localRepo, localRef)
+	if err != nil {
+		return fmt.Errorf("image %s: %s", image, err.Error())
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		// the stored manifest is the one resolved from a manifest list if the digest names a list
+		ref = digest
+	}
+	ref, err = c.copyManifest(ctx, localRepo, repo, digest, ref)
+	if err != nil {
+		return fmt.Errorf("image %s: %s", image, err.Error())
+	}
+	log.Printf("image %s copied to %s/%s:%s \n", image, c.Host, repo, ref)
+	return nil
+}
+
+// copyManifest push the blobs of the manifest digest, then the manifest itself as ref, and return the ref pushed.
+// for a manifest list, the manifests present in the storage are pushed first. a list some platforms of which were
+// left out by dump is rewritten to the ones present, a registry refuses a list of missing manifests.
+// its digest changes, a ref naming the digest is replaced by the new one
+func (c *RegistryCopier) copyManifest(ctx context.Context, localRepo string, repo string, digest string, ref string) (string, error) {
+	body, err := c.Storage.ReadBlob(digest)
+	if err != nil {
+		return "", err
+	}
+	m, err := ParseManifest(body, "")
+	if err != nil {
+		return "", err
+	}
+	if IsIndexMediaType(m.MediaType) {
+		present := make(map[string]bool)
+		for _, desc := range m.Manifests {
+			if !c.Storage.HasManifest(localRepo, desc.Digest) || !c.Storage.HasBlob(desc.Digest) {
+				continue
+			}
+			_, err = c.copyManifest(ctx, localRepo, repo, desc.Digest, desc.Digest)
+			if err != nil {
+				return "", err
+			}
+			present[desc.Digest] = true
+		}
+		if len(present) == 0 {
+			return "", fmt.Errorf("none of the %d manifests of list %s is in the archive", len(m.Manifests), digest)
+		}
+		if len(present) != len(m.Manifests) {
+			body, err = filterManifestList(body, present)
+			if err != nil {
+				return "", err
+			}
+			log.Printf("manifest list %s keeps the %d of its %d manifests in the archive, pushed as %s \n",
+				digest, len(present), len(m.Manifests), Digest(body))
+			if ref == digest {
+				ref = Digest(body)
+			}
+		}
+	}
+	for _, blob := range m.Blobs() {
+		err = c.copyBlob(ctx, repo, blob)
+		if err != nil {
+			return "", err
+		}
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = MEDIA_TYPE_OCI_MANIFEST
+	}
+	return ref, c.Client.PutManifest(ctx, c.Host, repo, ref, mediaType, body)
+}
+
+// filterManifestList return the manifest list body with the manifests of keep only, its other fields untouched
+func filterManifestList(body []byte, keep map[string]bool) ([]byte, error) {
+	var list map[string]json.RawMessage
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []json.RawMessage
+	err = json.Unmarshal(list["manifests"], &manifests)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]json.RawMessage, 0, len(keep))
+	for _, raw := range manifests {
+		var desc Descriptor
+		err = json.Unmarshal(raw, &desc)
+		if err != nil {
+			return nil, err
+		}
+		if keep[desc.Digest] {
+			kept = append(kept, raw)
+		}
+	}
+	list["manifests"], err = json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(list)
+}
+
+func (c *RegistryCopier) copyBlob(ctx context.Context, repo string, blob Descriptor) error {
+	exist, err := c.Client.BlobExists(ctx, c.Host, repo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+	file, err := c.Storage.OpenBlob(blob.Digest)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return c.Client.UploadBlob(ctx, c.Host, repo, blob.Digest, info.Size(), func() (io.ReadCloser, error) {
+		return c.Storage.OpenBlob(blob.Digest)
+	})
+}
+
+// CopyAll copy all images pair (remote => local tag) in a multi-go-routine.
+// each go routine copy one item at a time from work queue
+func (c *RegistryCopier) CopyAll(ctx context.Context, images map[string]string) error {
+	items := make([]string, 0, len(images))
+	for k := range images {
+		items = append(items, k)
+	}
+	sort.Strings(items)
+	results := runBatch(ctx, "copy", items, c.Parallelism, c.FailFast, 0, c.Retry, func(ctx context.Context, image string) error {
+		return c.Copy(ctx, image, images[image])
+	})
+	return results.Err("copy")
+}
+
+// NewDefaultRegistryCopier return a copier of the registry data dir dataPath to target,
+// in the form of registry.internal:5000[/prefix]
+func NewDefaultRegistryCopier(dataPath string, target string, client *Client) (*RegistryCopier, error) {
+	host, prefix, err := ParseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return &RegistryCopier{
+		Client:      client,
+		Storage:     NewStorage(dataPath),
+		Host:        host,
+		Prefix:      prefix,
+		Parallelism: runtime.NumCPU(),
+		Retry:       NewDefaultRetryPolicy(),
+	}, nil
+}
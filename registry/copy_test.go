@@ -0,0 +1,173 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTarget accepts blob uploads and manifest pushes behind basic auth
+type fakeTarget struct {
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte // by repo:ref
+	failures  int               // manifest pushes answered by a 502 before they are accepted
+}
+
+func (f *fakeTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok || username != "admin" || password != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	path := req.URL.Path
+	switch {
+	case req.Method == http.MethodHead && strings.Contains(path, "/blobs/"):
+		if _, ok := f.blobs[path[strings.LastIndex(path, "/")+1:]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/blobs/uploads/"):
+		w.Header().Set("Location", path+"some-uuid?_state=opaque")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && strings.HasSuffix(path, "/blobs/uploads/some-uuid"):
+		body, _ := io.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if Digest(body) != digest || req.URL.Query().Get("_state") != "opaque" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && strings.Contains(path, "/manifests/") && f.failures > 0:
+		f.failures--
+		w.WriteHeader(http.StatusBadGateway)
+	case req.Method == http.MethodPut && strings.Contains(path, "/manifests/"):
+		body, _ := io.ReadAll(req.Body)
+		i := strings.LastIndex(path, "/manifests/")
+		f.manifests[strings.TrimPrefix(path[:i], "/v2/")+":"+path[i+len("/manifests/"):]] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRegistryCopier_CopyAll(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	_, body := remote.addImage("v1", "layer", nil)
+	source := httptest.NewServer(remote)
+	defer source.Close()
+	image := strings.TrimPrefix(source.URL, "http://") + "/cicd/app:v1"
+
+	dataPath := t.TempDir()
+	fetcher := NewDefaultNativeFetcher(dataPath)
+	images := map[string]string{image: "localhost:5000/app:v1"}
+	if err := fetcher.FetchAll(context.Background(), images); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	target := &fakeTarget{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	client := NewDefaultClient()
+	client.Credentials = func(host string) (string, string, error) {
+		return "admin", "secret", nil
+	}
+	copier, err := NewDefaultRegistryCopier(dataPath, strings.TrimPrefix(server.URL, "http://")+"/offline/", client)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// a 502 of the target is retried
+	target.failures = 2
+	copier.Retry = RetryPolicy{Retries: 3, Delay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	if err = copier.CopyAll(context.Background(), images); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if got := string(target.manifests["offline/cicd/app:v1"]); got != string(body) {
+		t.Errorf("manifest not pushed as offline/cicd/app:v1, got %v", target.manifests)
+	}
+	if string(target.blobs[Digest([]byte("layer"))]) != "layer" {
+		t.Error("layer is not uploaded")
+	}
+	if len(target.blobs) != 2 {
+		t.Errorf("expected the config and the layer, got %d blobs", len(target.blobs))
+	}
+}
+
+func TestRegistryCopier_PartialList(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	amd64, _ := remote.addImage("", "amd64 layer", &Platform{OS: "linux", Architecture: "amd64"})
+	arm64, _ := remote.addImage("", "arm64 layer", &Platform{OS: "linux", Architecture: "arm64"})
+	list := remote.addIndex("v1", amd64, arm64)
+	source := httptest.NewServer(remote)
+	defer source.Close()
+	host := strings.TrimPrefix(source.URL, "http://")
+
+	// dump --platform linux/amd64 keeps the whole list but the amd64 manifest only
+	dataPath := t.TempDir()
+	fetcher := NewDefaultNativeFetcher(dataPath)
+	fetcher.Platforms, _ = ParsePlatforms("linux/amd64")
+	images := map[string]string{
+		host + "/cicd/app:v1":      "localhost:5000/app:v1",
+		host + "/cicd/app@" + list: "localhost:5000/app:" + DigestTag(list),
+	}
+	if err := fetcher.FetchAll(context.Background(), images); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	target := &fakeTarget{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(target)
+	defer server.Close()
+	client := NewDefaultClient()
+	client.Credentials = func(host string) (string, string, error) {
+		return "admin", "secret", nil
+	}
+	copier, err := NewDefaultRegistryCopier(dataPath, strings.TrimPrefix(server.URL, "http://"), client)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = copier.CopyAll(context.Background(), images); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pushed, err := ParseManifest(target.manifests["cicd/app:v1"], "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(pushed.Manifests) != 1 || pushed.Manifests[0].Digest != amd64.Digest {
+		t.Errorf("the list should be rewritten to the amd64 manifest, got %s", target.manifests["cicd/app:v1"])
+	}
+	if _, ok := target.manifests["cicd/app:"+amd64.Digest]; !ok {
+		t.Error("the amd64 manifest should be pushed")
+	}
+	if _, ok := target.manifests["cicd/app:"+arm64.Digest]; ok {
+		t.Error("the arm64 manifest isn't in the archive, it can't be pushed")
+	}
+	// the image pinned to the list is pushed by the digest of the rewritten list
+	rewritten := Digest(target.manifests["cicd/app:v1"])
+	if _, ok := target.manifests["cicd/app:"+rewritten]; !ok || rewritten == list {
+		t.Errorf("the pinned image should be pushed as %s, got %v", rewritten, target.manifests)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	cases := map[string][2]string{
+		"registry.internal:5000":            {"registry.internal:5000", ""},
+		"registry.internal:5000/offline/":   {"registry.internal:5000", "offline"},
+		"https://harbor.local/project/team": {"harbor.local", "project/team"},
+	}
+	for target, want := range cases {
+		host, prefix, err := ParseTarget(target)
+		if err != nil || [2]string{host, prefix} != want {
+			t.Errorf("%s: got %s %s %v", target, host, prefix, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	paths "path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// this section implements incremental dumps: blobs carried by a base archive are left out of
+// the dumped archive, which records them in delta.json so load can check they are present
+
+var (
+	// DELTA_FILE_NAME is the name of the delta description in an archive
+	DELTA_FILE_NAME = "delta.json"
+)
+
+// Delta describes an archive dumped against a base archive
+type Delta struct {
+	// Base is the file name of the base archive
+	Base string `json:"base"`
+
+	// Blobs are the digests of the blobs left out, as the base carries them
+	Blobs []string `json:"blobs"`
+}
+
+// NewDelta return the delta of the blobs required from the base archive
+func NewDelta(base string, required map[string]bool) *Delta {
+	blobs := make([]string, 0, len(required))
+	for digest := range required {
+		blobs = append(blobs, digest)
+	}
+	sort.Strings(blobs)
+	return &Delta{Base: filepath.Base(base), Blobs: blobs}
+}
+
+// Missing return the blobs of the base which are absent in storage
+func (d *Delta) Missing(storage *Storage) []string {
+	ret := make([]string, 0)
+	for _, digest := range d.Blobs {
+		if !storage.HasBlob(digest) {
+			ret = append(ret, digest)
+		}
+	}
+	return ret
+}
+
+// PersistentDeltaToFile persistent the delta into file
+func PersistentDeltaToFile(delta *Delta, file string) error {
+	bytes, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, bytes, 0644)
+}
+
+// ParseDeltaFromFile parse the delta from file
+func ParseDeltaFromFile(file string) (*Delta, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	delta := &Delta{}
+	err = json.Unmarshal(bytes, delta)
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
+
+// ReadArchiveBlobs stream the tar.gz archive and return the digests of the blobs it carries,
+// in the registry or the OCI layout. if the archive is a delta itself, the blobs it requires
+// from its own base are part of the set, as loading it makes them present as well
+func ReadArchiveBlobs(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	reader := tar.NewReader(gz)
+	ret := make(map[string]bool)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if digest, ok := blobDigestFromPath(header.Name); ok {
+			ret[digest] = true
+			continue
+		}
+		if paths.Base(header.Name) == DELTA_FILE_NAME {
+			delta := &Delta{}
+			err = json.NewDecoder(reader).Decode(delta)
+			if err != nil {
+				return nil, err
+			}
+			for _, digest := range delta.Blobs {
+				ret[digest] = true
+			}
+		}
+	}
+	return ret, nil
+}
+
+// blobDigestFromPath tell the digest of a blob from its path in an archive:
+// .../blobs/sha256/<2 hex>/<hex>/data in the registry layout, blobs/sha256/<hex> in the OCI layout
+func blobDigestFromPath(name string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, "./"), "/")
+	n := len(parts)
+	var encoded string
+	switch {
+	case n >= 5 && parts[n-1] == "data" && parts[n-4] == "sha256" && parts[n-5] == "blobs":
+		encoded = parts[n-2]
+	case n == 3 && parts[0] == "blobs" && parts[1] == "sha256":
+		encoded = parts[2]
+	default:
+		return "", false
+	}
+	digest := "sha256:" + encoded
+	if _, _, err := splitDigest(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// pruneBaseBlobs remove the blobs of the base from the registry data dir,
+// return the digests removed
+func pruneBaseBlobs(dataPath string, base map[string]bool) (map[string]bool, error) {
+	pruned := make(map[string]bool)
+	root := paths.Join(dataPath, REGISTRY_STORAGE_ROOT, "blobs")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		digest, ok := blobDigestFromPath(filepath.ToSlash(path))
+		if !ok || !base[digest] {
+			return nil
+		}
+		pruned[digest] = true
+		return os.Remove(path)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+func TestNativeFetcher_Base(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	desc, _ := remote.addImage("v1", "shared layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1"
+
+	layer := Digest([]byte("shared layer"))
+	fetcher := NewDefaultNativeFetcher(t.TempDir())
+	fetcher.Base = map[string]bool{layer: true}
+	err := fetcher.FetchAll(context.Background(), map[string]string{image: "localhost:5000/app:v1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fetcher.Storage.HasBlob(layer) {
+		t.Error("the layer carried by the base should be left out")
+	}
+	if !fetcher.Storage.HasBlob(desc.Digest) {
+		t.Error("the manifest is new and should be fetched")
+	}
+	if required := fetcher.Required(); len(required) != 1 || !required[layer] {
+		t.Errorf("unexpected required blobs %v", required)
+	}
+}
+
+func TestReadArchiveBlobs(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorage(paths.Join(dir, "data"))
+	content := []byte("blob")
+	if err := storage.WriteBlob(Digest(content), strings.NewReader("blob")); err != nil {
+		t.Fatal(err.Error())
+	}
+	inherited := Digest([]byte("from the base of the base"))
+	if err := PersistentDeltaToFile(NewDelta("base.tar.gz", map[string]bool{inherited: true}), paths.Join(dir, DELTA_FILE_NAME)); err != nil {
+		t.Fatal(err.Error())
+	}
+	archive := paths.Join(t.TempDir(), "delta.tar.gz")
+	if err := TarCompressDirTo(context.Background(), archive, dir, "data", DELTA_FILE_NAME); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	blobs, err := ReadArchiveBlobs(archive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(blobs) != 2 || !blobs[Digest(content)] || !blobs[inherited] {
+		t.Errorf("unexpected blobs %v", blobs)
+	}
+
+	delta := NewDelta("base.tar.gz", blobs)
+	if missing := delta.Missing(storage); len(missing) != 1 || missing[0] != inherited {
+		t.Errorf("unexpected missing blobs %v", missing)
+	}
+}
+
+func TestBlobDigestFromPath(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	cases := map[string]bool{
+		"tmp/dump-1/data/docker/registry/v2/blobs/sha256/ab/" + hex + "/data": true,
+		"blobs/sha256/" + hex:   true,
+		"./blobs/sha256/" + hex: true,
+		"data/docker/registry/v2/repositories/app/_layers/sha256/" + hex + "/link": false,
+		"blobs/sha256/not-a-digest": false,
+	}
+	for path, want := range cases {
+		digest, ok := blobDigestFromPath(path)
+		if ok != want || (ok && digest != "sha256:"+hex) {
+			t.Errorf("%s: got %s %v", path, digest, ok)
+		}
+	}
+}
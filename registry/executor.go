@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// this section runs the commands of the container runtimes and of the tools around them. arguments are handed
+// to the process as they are, never through a shell, so an image reference can't be interpreted as shell code
+
+var (
+	// EXECUTOR runs every command of the package
+	EXECUTOR Executor = NewDefaultExecutor()
+)
+
+// Executor runs commands
+type Executor interface {
+	// Run run argv[0] with the arguments argv[1:], reading stdin unless it's nil, and return its stdout and stderr.
+	// the process and the ones it started are killed once ctx is done
+	Run(ctx context.Context, argv []string, stdin io.Reader) (string, string, error)
+}
+
+// ExecError is a command which failed to start, exited non-zero or was killed
+type ExecError struct {
+	// Argv of the command
+	Argv []string
+
+	// Stderr of the command
+	Stderr string
+
+	// Err is why the command failed, ctx.Err() if it was killed as its context was done
+	Err error
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %s", strings.Join(e.Argv, " "), e.Err.Error())
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ", " + stderr
+	}
+	return msg
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// processExecutor runs the commands as child processes, each in a process group of its own
+type processExecutor struct{}
+
+// NewDefaultExecutor return the executor running the commands as child processes
+func NewDefaultExecutor() Executor {
+	return processExecutor{}
+}
+
+func (processExecutor) Run(ctx context.Context, argv []string, stdin io.Reader) (string, string, error) {
+	if len(argv) == 0 {
+		return "", "", fmt.Errorf("no command to run")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, &stdout, &stderr
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return "", "", &ExecError{Argv: argv, Err: err}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = ctx.Err()
+	}
+	if err != nil {
+		return stdout.String(), stderr.String(), &ExecError{Argv: argv, Stderr: stderr.String(), Err: err}
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+// runCommand run argv by EXECUTOR, return its stdout
+func runCommand(ctx context.Context, argv ...string) (string, error) {
+	stdout, _, err := EXECUTOR.Run(ctx, argv, nil)
+	return stdout, err
+}
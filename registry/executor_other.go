@@ -0,0 +1,27 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package registry
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup do nothing, process groups are unix only
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kill the started cmd, the processes it started are left running
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// processAlive return true if the process of pid is found, which may be a finished one on some platforms
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// ownedByCurrentUser return true, the owner of files is unix only
+func ownedByCurrentUser(info os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutor_NoShell(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "injected")
+	image := "busybox;touch " + marker + ";$(touch " + marker + ")"
+	stdout, _, err := NewDefaultExecutor().Run(context.Background(), []string{"echo", image}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.TrimSpace(stdout) != image {
+		t.Errorf("the argument should be passed as it is, got %q", stdout)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the argument should not be run by a shell")
+	}
+}
+
+func TestExecutor_Output(t *testing.T) {
+	stdout, stderr, err := NewDefaultExecutor().Run(context.Background(), []string{"sh", "-c", "cat; echo oops >&2; exit 3"}, strings.NewReader("in"))
+	if stdout != "in" || strings.TrimSpace(stderr) != "oops" {
+		t.Errorf("unexpected stdout %q and stderr %q", stdout, stderr)
+	}
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || !strings.Contains(err.Error(), "exit status 3, oops") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	_, _, err = NewDefaultExecutor().Run(context.Background(), []string{"no-such-command-of-image-batch"}, nil)
+	if err == nil {
+		t.Error("a missing command should fail")
+	}
+}
+
+func TestExecutor_Cancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// the child sleep holds stdout, it must be killed along with the shell for Run to return
+	_, _, err := NewDefaultExecutor().Run(ctx, []string{"sh", "-c", "sleep 30 & sleep 30"}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the command should be killed by the deadline, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("the process group should be killed")
+	}
+}
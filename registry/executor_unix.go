@@ -0,0 +1,34 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package registry
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup start cmd in a process group of its own, so the processes it starts can be killed along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kill the process group of the started cmd
+func killProcessGroup(cmd *exec.Cmd) {
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// processAlive return true if the process of pid is running
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// ownedByCurrentUser return true if the file of info belongs to the user of the process
+func ownedByCurrentUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || int(stat.Uid) == os.Getuid()
+}
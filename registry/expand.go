@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	paths "path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// this section expands the image patterns of image lists, such as registry.vendor.com/product/* or
+// registry.vendor.com/product/api:~1.4, into the images they stand for, listed through /v2/_catalog
+// and /v2/<name>/tags/list
+
+// ImagePattern is an image list entry standing for the tags of one or more repositories
+type ImagePattern struct {
+	// Domain is the registry host
+	Domain string
+
+	// Repository is the repository or a pattern of repositories, as path.Match understands it
+	Repository string
+
+	// Tag is a pattern of tags, as path.Match understands it, or a version range starting with ~ or ^.
+	// empty for every tag
+	Tag string
+}
+
+// IsImagePattern return true if reference is a pattern rather than an image, see ParseImagePattern
+func IsImagePattern(reference string) bool {
+	return strings.ContainsAny(reference, "*?[~^")
+}
+
+// ParseImagePattern parse a pattern such as registry.vendor.com/product/*, registry.vendor.com/product/api:~1.4
+// or registry.vendor.com/product/api:1.4.*. a repository pattern never matches across a slash
+func ParseImagePattern(reference string) (ImagePattern, error) {
+	s := strings.TrimSpace(reference)
+	if strings.Contains(s, "@") {
+		return ImagePattern{}, fmt.Errorf("image pattern %s can't be pinned to a digest", reference)
+	}
+	p := ImagePattern{}
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		s, p.Tag = s[:i], s[i+1:]
+		if p.Tag == "" {
+			return ImagePattern{}, fmt.Errorf("image pattern %s: empty tag", reference)
+		}
+	}
+	p.Domain, p.Repository = splitDomain(s)
+	if p.Domain != DOCKER_HUB_HOST && !domainRegexp.MatchString(p.Domain) {
+		return ImagePattern{}, fmt.Errorf("image pattern %s: malformed registry host %q", reference, p.Domain)
+	}
+	if _, err := paths.Match(p.Repository, ""); err != nil || strings.ToLower(p.Repository) != p.Repository {
+		return ImagePattern{}, fmt.Errorf("image pattern %s: malformed repository pattern %q", reference, p.Repository)
+	}
+	if isVersionRangeTag(p.Tag) {
+		if _, err := ParseVersionRange(p.Tag); err != nil {
+			return ImagePattern{}, fmt.Errorf("image pattern %s: %s", reference, err.Error())
+		}
+	} else if _, err := paths.Match(p.Tag, ""); err != nil {
+		return ImagePattern{}, fmt.Errorf("image pattern %s: malformed tag pattern %q", reference, p.Tag)
+	}
+	return p, nil
+}
+
+func isVersionRangeTag(tag string) bool {
+	return strings.HasPrefix(tag, "~") || strings.HasPrefix(tag, "^")
+}
+
+// checkImageReference check reference is an image, or an image pattern
+func checkImageReference(reference string) error {
+	if IsImagePattern(reference) {
+		_, err := ParseImagePattern(reference)
+		return err
+	}
+	_, err := ParseReference(reference)
+	return err
+}
+
+// isExpanded return true if entry stands for the images listed by the registry, see ExpandImageList
+func (e ImageListEntry) isExpanded() bool {
+	return IsImagePattern(e.Reference) || e.TagRegex != "" || e.Semver != "" || e.MaxTags != 0
+}
+
+// ExpandImageList replace the image patterns of entries, and the entries with tag filters, by the images
+// they stand for, listed by client. the images keep the settings of their entry, the other entries are kept as is
+func ExpandImageList(ctx context.Context, client *Client, entries []ImageListEntry) ([]ImageListEntry, error) {
+	catalogs := make(map[string][]string)
+	ret := make([]ImageListEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.isExpanded() {
+			ret = append(ret, entry)
+			continue
+		}
+		images, err := expandImagePattern(ctx, client, entry, catalogs)
+		if err != nil {
+			return nil, err
+		}
+		if len(images) == 0 {
+			return nil, fmt.Errorf("image pattern %s matches no image", entry.Reference)
+		}
+		log.Printf("image pattern %s expanded into %d images \n", entry.Reference, len(images))
+		for _, image := range images {
+			expanded := entry
+			expanded.Reference = image
+			expanded.TagRegex, expanded.Semver, expanded.MaxTags = "", "", 0
+			ret = append(ret, expanded)
+		}
+	}
+	return ret, nil
+}
+
+// expandImagePattern return the images of entry, catalogs caches the repositories by host
+func expandImagePattern(ctx context.Context, client *Client, entry ImageListEntry, catalogs map[string][]string) ([]string, error) {
+	pattern, err := ParseImagePattern(entry.Reference)
+	if err != nil {
+		return nil, err
+	}
+	repositories := []string{pattern.Repository}
+	if strings.ContainsAny(pattern.Repository, "*?[") {
+		catalog, ok := catalogs[pattern.Domain]
+		if !ok {
+			catalog, err = client.Catalog(ctx, pattern.Domain)
+			if err != nil {
+				return nil, fmt.Errorf("image pattern %s: listing the repositories of %s: %s", entry.Reference, pattern.Domain, err.Error())
+			}
+			catalogs[pattern.Domain] = catalog
+		}
+		repositories = make([]string, 0)
+		for _, repository := range catalog {
+			if ok, _ := paths.Match(pattern.Repository, repository); ok {
+				repositories = append(repositories, repository)
+			}
+		}
+		sort.Strings(repositories)
+	}
+	filter, err := newTagFilter(pattern.Tag, entry.ImageSettings)
+	if err != nil {
+		return nil, fmt.Errorf("image pattern %s: %s", entry.Reference, err.Error())
+	}
+	ret := make([]string, 0)
+	for _, repository := range repositories {
+		tags, err := client.ListTags(ctx, pattern.Domain, repository)
+		if err != nil {
+			return nil, fmt.Errorf("image pattern %s: listing the tags of %s/%s: %s", entry.Reference, pattern.Domain, repository, err.Error())
+		}
+		for _, tag := range filter.Select(tags) {
+			ret = append(ret, pattern.Domain+"/"+repository+":"+tag)
+		}
+	}
+	return ret, nil
+}
+
+// tagFilter selects the tags of a repository
+type tagFilter struct {
+	glob    string
+	regex   *regexp.Regexp
+	ranges  []VersionRange
+	maxTags int
+}
+
+func newTagFilter(tag string, settings ImageSettings) (*tagFilter, error) {
+	f := &tagFilter{maxTags: settings.MaxTags}
+	if isVersionRangeTag(tag) {
+		r, err := ParseVersionRange(tag)
+		if err != nil {
+			return nil, err
+		}
+		f.ranges = append(f.ranges, r)
+	} else {
+		f.glob = tag
+	}
+	if settings.Semver != "" {
+		r, err := ParseVersionRange(settings.Semver)
+		if err != nil {
+			return nil, err
+		}
+		f.ranges = append(f.ranges, r)
+	}
+	if settings.TagRegex != "" {
+		regex, err := regexp.Compile(settings.TagRegex)
+		if err != nil {
+			return nil, fmt.Errorf("tag regex %s: %s", settings.TagRegex, err.Error())
+		}
+		f.regex = regex
+	}
+	return f, nil
+}
+
+// Select return the tags matching the filter, newest first, at most maxTags if it's not 0.
+// the versions are newer than the other tags, which are sorted backwards
+func (f *tagFilter) Select(tags []string) []string {
+	ret := make([]string, 0)
+	for _, tag := range tags {
+		if f.glob != "" {
+			if ok, _ := paths.Match(f.glob, tag); !ok {
+				continue
+			}
+		}
+		if f.regex != nil && !f.regex.MatchString(tag) {
+			continue
+		}
+		if len(f.ranges) != 0 {
+			version, ok := ParseVersion(tag)
+			if !ok || !allContain(f.ranges, version) {
+				continue
+			}
+		}
+		ret = append(ret, tag)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		a, okA := ParseVersion(ret[i])
+		b, okB := ParseVersion(ret[j])
+		if okA && okB && a.Compare(b) != 0 {
+			return a.Compare(b) > 0
+		}
+		if okA != okB {
+			return okA
+		}
+		return ret[i] > ret[j]
+	})
+	if f.maxTags > 0 && len(ret) > f.maxTags {
+		ret = ret[:f.maxTags]
+	}
+	return ret
+}
+
+func allContain(ranges []VersionRange, version Version) bool {
+	for _, r := range ranges {
+		if !r.Contains(version) {
+			return false
+		}
+	}
+	return true
+}
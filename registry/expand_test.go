@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeCatalog serves the catalog and tags APIs, a page holds two items at most
+type fakeCatalog map[string][]string
+
+func (f fakeCatalog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var items []string
+	key := ""
+	if req.URL.Path == "/v2/_catalog" {
+		key = "repositories"
+		for repository := range f {
+			items = append(items, repository)
+		}
+		sort.Strings(items)
+	} else if repository := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v2/"), "/tags/list"); f[repository] != nil {
+		key, items = "tags", f[repository]
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	start, _ := strconv.Atoi(req.URL.Query().Get("start"))
+	end := start + 2
+	if end < len(items) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s?start=%d>; rel="next"`, req.URL.Path, end))
+	} else {
+		end = len(items)
+	}
+	json.NewEncoder(w).Encode(map[string][]string{key: items[start:end]})
+}
+
+func TestParseImagePattern(t *testing.T) {
+	cases := map[string]ImagePattern{
+		"registry.vendor.com/product/*":        {Domain: "registry.vendor.com", Repository: "product/*"},
+		"registry.vendor.com/product/api:~1.4": {Domain: "registry.vendor.com", Repository: "product/api", Tag: "~1.4"},
+		"registry:5000/product/api-*:1.4.*":    {Domain: "registry:5000", Repository: "product/api-*", Tag: "1.4.*"},
+		"nginx:^1.25":                          {Domain: "docker.io", Repository: "library/nginx", Tag: "^1.25"},
+	}
+	for reference, want := range cases {
+		got, err := ParseImagePattern(reference)
+		if err != nil {
+			t.Errorf("%s: %s", reference, err.Error())
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", reference, got, want)
+		}
+	}
+	for _, reference := range []string{"registry.vendor.com/product/*@sha256:" + strings.Repeat("a", 64), "registry.vendor.com/product/[", "registry.vendor.com/product/api:~1.x.y", "registry.vendor.com/product/api:^x.x.1"} {
+		if _, err := ParseImagePattern(reference); err == nil {
+			t.Errorf("%s should be refused", reference)
+		}
+	}
+}
+
+func TestExpandImageList(t *testing.T) {
+	server := httptest.NewServer(fakeCatalog{
+		"product/api":    {"1.3.0", "1.4.0", "1.4.2", "1.5.0-rc.1", "1.5.0", "2.0.0", "latest"},
+		"product/web":    {"1.4.1", "dev"},
+		"product/db":     {"16.1", "15.4"},
+		"other/product":  {"1.4.0"},
+		"product/sub/ui": {"1.4.0"},
+	})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	entries := []ImageListEntry{
+		{Reference: "busybox"},
+		{Reference: host + "/product/api:~1.4", ImageSettings: ImageSettings{Groups: []string{"vendor"}}},
+		{Reference: host + "/product/*", ImageSettings: ImageSettings{Semver: ">=1.4 <2", MaxTags: 1}},
+		{Reference: host + "/product/db", ImageSettings: ImageSettings{TagRegex: `^1[56]\.`}},
+	}
+	expanded, err := ExpandImageList(context.Background(), NewDefaultClient(), entries)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got := make([]string, 0)
+	for _, entry := range expanded {
+		got = append(got, strings.TrimPrefix(entry.Reference, host+"/"))
+	}
+	want := []string{"busybox", "product/api:1.4.2", "product/api:1.4.0", "product/api:1.5.0", "product/web:1.4.1", "product/db:16.1", "product/db:15.4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(expanded[1].Groups) != 1 || expanded[1].Groups[0] != "vendor" || expanded[3].MaxTags != 0 {
+		t.Errorf("the expanded images should keep the settings but the tag filters, got %+v", expanded)
+	}
+
+	_, err = ExpandImageList(context.Background(), NewDefaultClient(), []ImageListEntry{{Reference: host + "/product/api:~3"}})
+	if err == nil || !strings.Contains(err.Error(), "matches no image") {
+		t.Errorf("a pattern matching nothing should be reported, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// this section reads image lists: the plain one, one image per line, and the structured one in yaml or json,
+// with groups, includes of other lists and per-image settings:
+//
+//	include:
+//	  - base.yaml
+//	images:
+//	  - busybox
+//	groups:
+//	  - name: monitoring
+//	    platform: linux/amd64,linux/arm64
+//	    images:
+//	      - prom/prometheus:v2.45.0
+//	      - image: grafana/grafana:10.0.0
+//	        pullPolicy: IfNotPresent
+//	        alias: registry.internal/grafana:10
+//	      - image: registry.vendor.com/product/*
+//	        semver: ">=1.4 <2"
+//	        maxTags: 3
+
+var (
+	PULL_POLICY_NEVER = "Never"
+
+	// IMAGE_LIST_EXTENSIONS are the extensions of structured image lists, others are plain lists
+	IMAGE_LIST_EXTENSIONS = []string{".yaml", ".yml", ".json"}
+)
+
+// ImageSettings are the per-image settings of a structured image list
+type ImageSettings struct {
+	// Platforms kept out of the manifest list of the image, instead of the ones of dump --platform
+	Platforms []Platform
+
+	// AllPlatforms keep every platform of the manifest list of the image
+	AllPlatforms bool
+
+	// PullPolicy of the image on dump --daemon: PULL_POLICY_ALWAYS, PULL_POLICY_IFNOTPRESENT or PULL_POLICY_NEVER.
+	// empty means always
+	PullPolicy string
+
+	// Alias is the reference load restores the image as, instead of its original reference
+	Alias string
+
+	// Groups are the names of the groups the image is listed in, empty for top level images
+	Groups []string
+
+	// TagRegex keeps the tags of an image pattern matching it, see ExpandImageList
+	TagRegex string
+
+	// Semver keeps the tags of an image pattern in the version range, such as >=1.4 <2
+	Semver string
+
+	// MaxTags keeps the newest tags of each repository of an image pattern, every tag if 0
+	MaxTags int
+}
+
+// ImageListEntry is an image of an image list
+type ImageListEntry struct {
+	// Reference of the image as written in the list
+	Reference string
+
+	ImageSettings
+}
+
+type imageListFile struct {
+	Include []string         `yaml:"include"`
+	Images  []imageListItem  `yaml:"images"`
+	Groups  []imageListGroup `yaml:"groups"`
+}
+
+type imageListGroup struct {
+	Name       string          `yaml:"name"`
+	Platform   string          `yaml:"platform"`
+	PullPolicy string          `yaml:"pullPolicy"`
+	Images     []imageListItem `yaml:"images"`
+}
+
+// imageListItem is an image reference, or a mapping of the reference and its settings
+type imageListItem struct {
+	Image      string `yaml:"image"`
+	Platform   string `yaml:"platform"`
+	PullPolicy string `yaml:"pullPolicy"`
+	Alias      string `yaml:"alias"`
+	TagRegex   string `yaml:"tagRegex"`
+	Semver     string `yaml:"semver"`
+	MaxTags    int    `yaml:"maxTags"`
+}
+
+func (i *imageListItem) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		i.Image = node.Value
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: an image must be a reference or a mapping", node.Line)
+	}
+	for k := 0; k < len(node.Content); k += 2 {
+		switch key := node.Content[k].Value; key {
+		case "image", "platform", "pullPolicy", "alias", "tagRegex", "semver", "maxTags":
+		default:
+			return fmt.Errorf("line %d: unknown field %q of an image", node.Content[k].Line, key)
+		}
+	}
+	type plain imageListItem
+	return node.Decode((*plain)(i))
+}
+
+// ParseImageList parse the image list at path. files ending with one of IMAGE_LIST_EXTENSIONS are structured lists,
+// others are plain lists with one image per line. `#` starts a comment in both.
+// an image listed more than once must have the same settings every time, it belongs to every group it's listed in
+func ParseImageList(path string) ([]ImageListEntry, error) {
+	entries := make([]ImageListEntry, 0)
+	err := parseImageList(path, make(map[string]bool), &entries)
+	if err != nil {
+		return nil, err
+	}
+	// drop the duplicates, merging their groups
+	seen := make(map[string]int)
+	ret := make([]ImageListEntry, 0, len(entries))
+	for _, entry := range entries {
+		if i, ok := seen[entry.Reference]; ok {
+			if !sameSettings(ret[i].ImageSettings, entry.ImageSettings) {
+				return nil, fmt.Errorf("image %s is listed more than once with different settings", entry.Reference)
+			}
+			for _, group := range entry.Groups {
+				if !containsString(ret[i].Groups, group) {
+					ret[i].Groups = append(ret[i].Groups, group)
+				}
+			}
+			continue
+		}
+		seen[entry.Reference] = len(ret)
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStructuredImageList return true if the list at path is in yaml or json
+func IsStructuredImageList(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range IMAGE_LIST_EXTENSIONS {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func parseImageList(path string, visiting map[string]bool, entries *[]ImageListEntry) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if visiting[abs] {
+		return fmt.Errorf("image list %s includes itself", path)
+	}
+	visiting[abs] = true
+	defer delete(visiting, abs)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !IsStructuredImageList(path) {
+		return parsePlainImageList(path, content, entries)
+	}
+
+	list := imageListFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&list)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("image list %s: %s", path, err.Error())
+	}
+	for _, include := range list.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		err = parseImageList(include, visiting, entries)
+		if err != nil {
+			return err
+		}
+	}
+	for _, item := range list.Images {
+		entry, err := newImageListEntry(item, imageListGroup{})
+		if err != nil {
+			return fmt.Errorf("image list %s: %s", path, err.Error())
+		}
+		*entries = append(*entries, entry)
+	}
+	names := make(map[string]bool)
+	for _, group := range list.Groups {
+		if strings.TrimSpace(group.Name) == "" {
+			return fmt.Errorf("image list %s: a group must have a name", path)
+		}
+		if names[group.Name] {
+			return fmt.Errorf("image list %s: group %s is defined twice", path, group.Name)
+		}
+		names[group.Name] = true
+		for _, item := range group.Images {
+			entry, err := newImageListEntry(item, group)
+			if err != nil {
+				return fmt.Errorf("image list %s: group %s: %s", path, group.Name, err.Error())
+			}
+			*entries = append(*entries, entry)
+		}
+	}
+	return nil
+}
+
+// parsePlainImageList parse one image per line, blank lines and comments are skipped
+func parsePlainImageList(path string, content []byte, entries *[]ImageListEntry) error {
+	for i, line := range strings.Split(string(content), "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := checkImageReference(line); err != nil {
+			return fmt.Errorf("%s line %d: %s", path, i+1, err.Error())
+		}
+		*entries = append(*entries, ImageListEntry{Reference: line})
+	}
+	return nil
+}
+
+// newImageListEntry check item, the settings of its group apply unless it has its own
+func newImageListEntry(item imageListItem, group imageListGroup) (ImageListEntry, error) {
+	entry := ImageListEntry{Reference: strings.TrimSpace(item.Image)}
+	if group.Name != "" {
+		entry.Groups = []string{group.Name}
+	}
+	if err := checkImageReference(entry.Reference); err != nil {
+		return entry, err
+	}
+
+	platform := firstNonEmpty(item.Platform, group.Platform)
+	if platform == PLATFORM_ALL {
+		entry.AllPlatforms = true
+	} else if platform != "" {
+		platforms, err := ParsePlatforms(platform)
+		if err != nil {
+			return entry, fmt.Errorf("image %s: %s", entry.Reference, err.Error())
+		}
+		entry.Platforms = platforms
+	}
+
+	policy := firstNonEmpty(item.PullPolicy, group.PullPolicy)
+	if policy != "" {
+		normalized, err := normalizePullPolicy(policy)
+		if err != nil {
+			return entry, fmt.Errorf("image %s: %s", entry.Reference, err.Error())
+		}
+		entry.PullPolicy = normalized
+	}
+
+	if alias := strings.TrimSpace(item.Alias); alias != "" {
+		ref, err := ParseReference(alias)
+		if err != nil {
+			return entry, fmt.Errorf("image %s: alias: %s", entry.Reference, err.Error())
+		}
+		if ref.Digest != "" {
+			return entry, fmt.Errorf("image %s: alias %s can't be pinned to a digest", entry.Reference, alias)
+		}
+		entry.Alias = alias
+	}
+
+	entry.TagRegex, entry.Semver, entry.MaxTags = item.TagRegex, strings.TrimSpace(item.Semver), item.MaxTags
+	if entry.MaxTags < 0 {
+		return entry, fmt.Errorf("image %s: maxTags can't be negative", entry.Reference)
+	}
+	if entry.isExpanded() {
+		if entry.Alias != "" {
+			return entry, fmt.Errorf("image %s: a pattern standing for several images can't have an alias", entry.Reference)
+		}
+		if _, err := newTagFilter("", entry.ImageSettings); err != nil {
+			return entry, fmt.Errorf("image %s: %s", entry.Reference, err.Error())
+		}
+		if _, err := ParseImagePattern(entry.Reference); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+// normalizePullPolicy return the pull policy of name, case insensitive
+func normalizePullPolicy(name string) (string, error) {
+	for _, policy := range []string{PULL_POLICY_ALWAYS, PULL_POLICY_IFNOTPRESENT, PULL_POLICY_NEVER} {
+		if strings.EqualFold(policy, strings.TrimSpace(name)) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pull policy %s, must be one of %s, %s or %s", name, PULL_POLICY_ALWAYS, PULL_POLICY_IFNOTPRESENT, PULL_POLICY_NEVER)
+}
+
+func sameSettings(a ImageSettings, b ImageSettings) bool {
+	if a.AllPlatforms != b.AllPlatforms || a.PullPolicy != b.PullPolicy || a.Alias != b.Alias || len(a.Platforms) != len(b.Platforms) ||
+		a.TagRegex != b.TagRegex || a.Semver != b.Semver || a.MaxTags != b.MaxTags {
+		return false
+	}
+	for i := range a.Platforms {
+		if a.Platforms[i] != b.Platforms[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// FilterGroups return the entries of the named groups, all entries if groups is empty
+func FilterGroups(entries []ImageListEntry, groups []string) ([]ImageListEntry, error) {
+	if len(groups) == 0 {
+		return entries, nil
+	}
+	wanted := make(map[string]bool)
+	for _, group := range groups {
+		wanted[group] = true
+	}
+	found := make(map[string]bool)
+	ret := make([]ImageListEntry, 0)
+	for _, entry := range entries {
+		matched := false
+		for _, group := range entry.Groups {
+			if wanted[group] {
+				found[group] = true
+				matched = true
+			}
+		}
+		if matched {
+			ret = append(ret, entry)
+		}
+	}
+	missing := make([]string, 0)
+	for group := range wanted {
+		if !found[group] {
+			missing = append(missing, group)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no images in group %s", strings.Join(missing, ","))
+	}
+	return ret, nil
+}
@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+func writeImageList(t *testing.T, dir string, name string, content string) string {
+	file := paths.Join(dir, name)
+	err := os.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return file
+}
+
+func TestParseImageList_Plain(t *testing.T) {
+	dir := t.TempDir()
+	file := writeImageList(t, dir, "images.txt", "# base images\nbusybox\n\nnginx:1.25 # web\nbusybox\n")
+	entries, err := ParseImageList(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 || entries[0].Reference != "busybox" || entries[1].Reference != "nginx:1.25" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	file = writeImageList(t, dir, "bad.txt", "busybox\nNginx\n")
+	if _, err := ParseImageList(file); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("a malformed reference should be reported with its line, got %v", err)
+	}
+}
+
+func TestParseImageList_Structured(t *testing.T) {
+	dir := t.TempDir()
+	writeImageList(t, dir, "base.json", `{"images": ["busybox"]}`)
+	file := writeImageList(t, dir, "images.yaml", `
+# everything the cluster runs
+include:
+  - base.json
+images:
+  - busybox
+  - image: nginx:1.25
+    platform: all
+groups:
+  - name: monitoring
+    platform: linux/amd64,linux/arm64
+    pullPolicy: ifnotpresent
+    images:
+      - prom/prometheus:v2.45.0
+      - image: grafana/grafana:10.0.0
+        platform: linux/arm64
+        pullPolicy: Never
+        alias: registry.internal/grafana:10
+`)
+	entries, err := ParseImageList(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 4 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries[0].Reference != "busybox" || entries[1].Reference != "nginx:1.25" || !entries[1].AllPlatforms {
+		t.Errorf("unexpected top level entries %+v", entries[:2])
+	}
+	prometheus, grafana := entries[2], entries[3]
+	if len(prometheus.Groups) != 1 || prometheus.Groups[0] != "monitoring" || len(prometheus.Platforms) != 2 || prometheus.PullPolicy != PULL_POLICY_IFNOTPRESENT {
+		t.Errorf("the group settings should apply, got %+v", prometheus)
+	}
+	if len(grafana.Platforms) != 1 || grafana.Platforms[0].Architecture != "arm64" || grafana.PullPolicy != PULL_POLICY_NEVER || grafana.Alias != "registry.internal/grafana:10" {
+		t.Errorf("the image settings should override the group ones, got %+v", grafana)
+	}
+
+	entries, err = FilterGroups(entries, []string{"monitoring"})
+	if err != nil || len(entries) != 2 {
+		t.Errorf("unexpected entries of monitoring %+v, %v", entries, err)
+	}
+	if _, err := FilterGroups(entries, []string{"logging"}); err == nil {
+		t.Error("an unknown group should be reported")
+	}
+}
+
+func TestParseImageList_SharedGroups(t *testing.T) {
+	dir := t.TempDir()
+	file := writeImageList(t, dir, "images.yaml", `
+groups:
+  - name: a
+    images:
+      - busybox
+      - nginx:1.25
+  - name: b
+    images:
+      - busybox
+`)
+	entries, err := ParseImageList(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 2 || len(entries[0].Groups) != 2 || entries[0].Groups[1] != "b" {
+		t.Fatalf("an image listed in two groups should belong to both, got %+v", entries)
+	}
+	for _, group := range []string{"a", "b"} {
+		filtered, err := FilterGroups(entries, []string{group})
+		if err != nil || filtered[0].Reference != "busybox" {
+			t.Errorf("busybox should be in group %s, got %+v, %v", group, filtered, err)
+		}
+	}
+	filtered, _ := FilterGroups(entries, []string{"a", "b"})
+	if len(filtered) != 2 {
+		t.Errorf("an image of both groups should be kept once, got %+v", filtered)
+	}
+}
+
+func TestParseImageList_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	writeImageList(t, dir, "a.yaml", "include: [b.yaml]\n")
+	writeImageList(t, dir, "b.yaml", "include: [a.yaml]\n")
+	cases := map[string]string{
+		"a.yaml":         "includes itself",
+		"unknown.yaml":   "field image not found",
+		"field.yaml":     "unknown field",
+		"conflict.yaml":  "different settings",
+		"group.yaml":     "must have a name",
+		"policy.yaml":    "unknown pull policy",
+		"alias.yaml":     "can't be pinned",
+		"duplicate.yaml": "defined twice",
+		"pattern.yaml":   "can't have an alias",
+		"regex.yaml":     "tag regex",
+	}
+	writeImageList(t, dir, "unknown.yaml", "image: [busybox]\n")
+	writeImageList(t, dir, "field.yaml", "images:\n  - image: busybox\n    tag: v1\n")
+	writeImageList(t, dir, "conflict.yaml", "images:\n  - busybox\n  - image: busybox\n    pullPolicy: Never\n")
+	writeImageList(t, dir, "group.yaml", "groups:\n  - images: [busybox]\n")
+	writeImageList(t, dir, "policy.yaml", "images:\n  - image: busybox\n    pullPolicy: sometimes\n")
+	writeImageList(t, dir, "alias.yaml", "images:\n  - image: busybox\n    alias: busybox@sha256:"+strings.Repeat("a", 64)+"\n")
+	writeImageList(t, dir, "duplicate.yaml", "groups:\n  - name: a\n  - name: a\n")
+	writeImageList(t, dir, "pattern.yaml", "images:\n  - image: registry.vendor.com/product/*\n    alias: registry.internal/product\n")
+	writeImageList(t, dir, "regex.yaml", "images:\n  - image: registry.vendor.com/product/api\n    tagRegex: \"v(\"\n")
+	for name, want := range cases {
+		_, err := ParseImageList(paths.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error containing %q", name, err, want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// this section maps remote images to the local tags they are stored as, and describes the mapping
+// in images.json so every original reference can be restored on load
+
+var (
+	// LOCAL_REGISTRY_HOST is the registry host of the local tags, replaced by the endpoint of the registry
+	// instance dump --daemon pushes to. load serves the tags of any host on an endpoint of its own
+	LOCAL_REGISTRY_HOST = "localhost:5000"
+
+	// IMAGES_FILE_VERSION is the version of images.json. archives of older versions carry a plain
+	// remote => local tag object instead
+	IMAGES_FILE_VERSION = 2
+
+	// MAX_LOCAL_NAME_LENGTH is the longest repository name a registry accepts
+	MAX_LOCAL_NAME_LENGTH = 255
+
+	// pathComponentRegexp matches a path component of a repository name
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+
+	// tagRegexp matches a tag
+	tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// ImageRecord describes an image of an archive
+type ImageRecord struct {
+	// Reference is the image as written in the image list, such as nginx:1.25
+	Reference string `json:"reference"`
+
+	// Host is the registry host of the image, such as docker.io
+	Host string `json:"host"`
+
+	// Repository is the repository of the image on Host, such as library/nginx
+	Repository string `json:"repository"`
+
+	// Tag of the image, empty if it's pinned to a digest only
+	Tag string `json:"tag,omitempty"`
+
+	// Digest is the manifest digest the image is pinned to or resolved to, empty if unknown
+	Digest string `json:"digest,omitempty"`
+
+	// Local is the tag the image is stored as, such as localhost:5000/docker.io/library/nginx:1.25
+	Local string `json:"local"`
+
+	// Alias is the reference load restores the image as instead of Reference, empty if none
+	Alias string `json:"alias,omitempty"`
+}
+
+// Target return the reference load restores the image as: its alias if any, otherwise see RetagTarget
+func (r ImageRecord) Target() (string, error) {
+	if r.Alias != "" {
+		return r.Alias, nil
+	}
+	return RetagTarget(r.Reference)
+}
+
+// ImageIndex is the content of images.json
+type ImageIndex struct {
+	// Version of the images.json format
+	Version int `json:"version"`
+
+	// Images of the archive, sorted by reference
+	Images []ImageRecord `json:"images"`
+}
+
+// LocalTag return the tag image is stored as locally. the registry host and the whole repository are kept,
+// so images of different registries and namespaces never share a local tag:
+// registry.geoway.com:5000/cicd/jenkins:v1 => localhost:5000/registry.geoway.com_5000/cicd/jenkins:v1.
+// a colon is not allowed in a repository name, it's replaced by an underscore, which no registry host contains.
+// an image pinned to a digest is tagged as DigestTag, busybox@sha256:<hex> => localhost:5000/docker.io/library/busybox:sha256-<hex>
+func LocalTag(image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	tag := ref.Tag
+	if ref.Digest != "" {
+		tag = DigestTag(ref.Digest)
+	}
+	name := strings.ReplaceAll(strings.ToLower(ref.Domain), ":", "_") + "/" + ref.Path
+	for _, component := range strings.Split(name, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return "", fmt.Errorf("image %s: %q can't be part of a local tag", image, component)
+		}
+	}
+	local := LOCAL_REGISTRY_HOST + "/" + name
+	if len(local) > MAX_LOCAL_NAME_LENGTH {
+		return "", fmt.Errorf("image %s: local name %s is longer than %d characters", image, local, MAX_LOCAL_NAME_LENGTH)
+	}
+	return local + ":" + tag, nil
+}
+
+// NewImageIndex return the index of images, remote => local tag. resolved is remote => manifest digest, may be nil
+func NewImageIndex(images map[string]string, resolved map[string]string) *ImageIndex {
+	index := &ImageIndex{Version: IMAGES_FILE_VERSION, Images: make([]ImageRecord, 0, len(images))}
+	for image, local := range images {
+		index.Images = append(index.Images, newImageRecord(image, local, resolved[image]))
+	}
+	sort.Slice(index.Images, func(i, j int) bool {
+		return index.Images[i].Reference < index.Images[j].Reference
+	})
+	return index
+}
+
+func newImageRecord(image string, local string, digest string) ImageRecord {
+	record := ImageRecord{Reference: image, Digest: digest, Local: local}
+	if ref, err := ParseReference(image); err == nil {
+		record.Host, record.Repository, record.Tag = ref.Domain, ref.Path, ref.Tag
+		if ref.Digest != "" {
+			record.Digest = ref.Digest
+		}
+	}
+	return record
+}
+
+// SetAliases set the alias of the images, image => alias
+func (i *ImageIndex) SetAliases(aliases map[string]string) {
+	for k := range i.Images {
+		i.Images[k].Alias = aliases[i.Images[k].Reference]
+	}
+}
+
+// Pairs return the images of the index, remote => local tag
+func (i *ImageIndex) Pairs() map[string]string {
+	ret := make(map[string]string, len(i.Images))
+	for _, record := range i.Images {
+		ret[record.Reference] = record.Local
+	}
+	return ret
+}
+
+// PersistentImageIndexToFile persistent the index into file
+func PersistentImageIndexToFile(index *ImageIndex, file string) error {
+	bytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(bytes, '\n'), 0644)
+}
+
+// ParseImageIndexFromFile parse images.json from file, see ParseImageIndex
+func ParseImageIndexFromFile(file string) (*ImageIndex, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImageIndex(bytes)
+}
+
+// ParseImageIndex parse images.json, the plain remote => local tag object of older archives is understood as well
+func ParseImageIndex(bytes []byte) (*ImageIndex, error) {
+	var probe map[string]json.RawMessage
+	err := json.Unmarshal(bytes, &probe)
+	if err != nil {
+		return nil, fmt.Errorf("malformed images.json: %s", err.Error())
+	}
+	_, hasVersion := probe["version"]
+	_, hasImages := probe["images"]
+	if !hasVersion || !hasImages {
+		var pairs map[string]string
+		err = json.Unmarshal(bytes, &pairs)
+		if err != nil {
+			return nil, fmt.Errorf("malformed images.json: %s", err.Error())
+		}
+		return NewImageIndex(pairs, nil), nil
+	}
+	index := &ImageIndex{}
+	err = json.Unmarshal(bytes, index)
+	if err != nil {
+		return nil, fmt.Errorf("malformed images.json: %s", err.Error())
+	}
+	if index.Version > IMAGES_FILE_VERSION {
+		return nil, fmt.Errorf("images.json of version %d is not supported, upgrade image-batch", index.Version)
+	}
+	return index, nil
+}
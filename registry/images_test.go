@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"os"
+	paths "path"
+	"testing"
+)
+
+func TestLocalTag(t *testing.T) {
+	cases := map[string]string{
+		"busybox":                "localhost:5000/docker.io/library/busybox:latest",
+		"a.com/team1/nginx:1.25": "localhost:5000/a.com/team1/nginx:1.25",
+		"b.com/team2/nginx:1.25": "localhost:5000/b.com/team2/nginx:1.25",
+		"registry.geoway.com:5000/cicd/jenkins:v1": "localhost:5000/registry.geoway.com_5000/cicd/jenkins:v1",
+		"Registry.Geoway.com/cicd/jenkins:v1":      "localhost:5000/registry.geoway.com/cicd/jenkins:v1",
+	}
+	for image, want := range cases {
+		got, err := LocalTag(image)
+		if err != nil {
+			t.Errorf("%s: %s", image, err.Error())
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %s, want %s", image, got, want)
+		}
+	}
+	for _, image := range []string{"a.com/Team/nginx", "a.com/team/nginx:-v1"} {
+		if _, err := LocalTag(image); err == nil {
+			t.Errorf("%s should not be mapped", image)
+		}
+	}
+}
+
+func TestTransformImageTag_Collision(t *testing.T) {
+	images, err := TransformImageTag([]string{"a.com/team1/nginx:1.25", "b.com/team2/nginx:1.25", "nginx", "docker.io/library/nginx:latest"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if images["a.com/team1/nginx:1.25"] == images["b.com/team2/nginx:1.25"] {
+		t.Error("images of different registries should not share a local tag")
+	}
+	if images["nginx"] != images["docker.io/library/nginx:latest"] {
+		t.Error("the same image written twice should share a local tag")
+	}
+	_, err = TransformImageTag([]string{"A.com/team/nginx", "a.com/team/nginx"})
+	if err != nil {
+		t.Errorf("hosts differing in case only are the same registry: %s", err.Error())
+	}
+}
+
+func TestParseImageIndex(t *testing.T) {
+	dir := t.TempDir()
+	images := map[string]string{"registry.geoway.com/cicd/jenkins:v1": "localhost:5000/registry.geoway.com/cicd/jenkins:v1"}
+	digest := Digest([]byte("manifest"))
+	err := PersistentImageIndexToFile(NewImageIndex(images, map[string]string{"registry.geoway.com/cicd/jenkins:v1": digest}), paths.Join(dir, "images.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, _ := os.ReadFile(paths.Join(dir, "images.json"))
+	index, err := ParseImageIndex(content)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := ImageRecord{
+		Reference:  "registry.geoway.com/cicd/jenkins:v1",
+		Host:       "registry.geoway.com",
+		Repository: "cicd/jenkins",
+		Tag:        "v1",
+		Digest:     digest,
+		Local:      "localhost:5000/registry.geoway.com/cicd/jenkins:v1",
+	}
+	if len(index.Images) != 1 || index.Images[0] != want {
+		t.Errorf("got %+v, want %+v", index.Images, want)
+	}
+
+	// images.json of older archives
+	legacy := []byte(`{"registry.geoway.com/cicd/jenkins:v1":"localhost:5000/jenkins:v1"}`)
+	index, err = ParseImageIndex(legacy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if pairs := index.Pairs(); len(pairs) != 1 || pairs["registry.geoway.com/cicd/jenkins:v1"] != "localhost:5000/jenkins:v1" {
+		t.Errorf("unexpected pairs %v", pairs)
+	}
+}
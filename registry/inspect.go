@@ -0,0 +1,75 @@
+package registry
+
+// ImageSummary describes an image of an archive, as listed by inspect
+type ImageSummary struct {
+	// Reference is the original image reference, such as nginx:1.25
+	Reference string `json:"reference"`
+
+	// LocalTag is the tag of the image in the registry layout, empty in the OCI layout
+	LocalTag string `json:"localTag,omitempty"`
+
+	// Digest of the manifest, or of the manifest list
+	Digest string `json:"digest"`
+
+	// Platforms of the image present in the archive
+	Platforms []string `json:"platforms"`
+
+	// Size is the compressed size in bytes of the manifests, configs and layers of the image carried by
+	// the archive. blobs left out as the base archive carries them are not counted
+	Size int64 `json:"size"`
+
+	// Layers is the number of distinct layers of the image
+	Layers int `json:"layers"`
+
+	// SharedLayers is the number of layers of the image which other images of the archive refer to as well
+	SharedLayers int `json:"sharedLayers"`
+}
+
+// InspectArchive stream the archive at path and summarize its images, sorted by reference
+func InspectArchive(path string) ([]*ImageSummary, error) {
+	contents, err := ScanArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	images := contents.Images()
+
+	// the number of images every layer belongs to
+	owners := make(map[string]int)
+	for _, image := range images {
+		for layer := range distinct(image.Layers) {
+			owners[layer]++
+		}
+	}
+
+	ret := make([]*ImageSummary, 0, len(images))
+	for _, image := range images {
+		summary := &ImageSummary{
+			Reference: image.Reference,
+			LocalTag:  image.LocalTag,
+			Digest:    image.Digest,
+			Platforms: make([]string, 0, len(image.Platforms)),
+		}
+		for _, platform := range image.Platforms {
+			summary.Platforms = append(summary.Platforms, platform.String())
+		}
+		for blob := range distinct(image.Blobs) {
+			summary.Size += contents.Blobs[blob]
+		}
+		for layer := range distinct(image.Layers) {
+			summary.Layers++
+			if owners[layer] > 1 {
+				summary.SharedLayers++
+			}
+		}
+		ret = append(ret, summary)
+	}
+	return ret, nil
+}
+
+func distinct(list []string) map[string]bool {
+	ret := make(map[string]bool, len(list))
+	for _, item := range list {
+		ret[item] = true
+	}
+	return ret
+}
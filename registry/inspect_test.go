@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInspectArchive(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	v1, v1Body := remote.addImage("v1", "shared layer", nil)
+	// v2 is built on top of v1
+	m := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MEDIA_TYPE_DOCKER_MANIFEST,
+		Config:        &Descriptor{Digest: Digest([]byte(`{"architecture":"arm64","os":"linux"}`))},
+		Layers: []Descriptor{
+			{Digest: Digest([]byte("shared layer")), Size: int64(len("shared layer"))},
+			{Digest: Digest([]byte("own layer")), Size: int64(len("own layer"))},
+		},
+	}
+	remote.blobs[m.Config.Digest] = []byte(`{"architecture":"arm64","os":"linux"}`)
+	remote.blobs[Digest([]byte("own layer"))] = []byte("own layer")
+	body, _ := json.Marshal(m)
+	remote.addManifest("v2", Digest(body), body, MEDIA_TYPE_DOCKER_MANIFEST)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	_, archive := dumpFakeArchive(t, map[string]string{
+		host + "/cicd/app:v1": "localhost:5000/app:v1",
+		host + "/cicd/app:v2": "localhost:5000/app:v2",
+	}, "")
+	images, err := InspectArchive(archive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+	first, second := images[0], images[1]
+	if first.Digest != v1.Digest || first.LocalTag != "localhost:5000/app:v1" || first.Layers != 1 || first.SharedLayers != 1 {
+		t.Errorf("unexpected summary of v1 %+v", first)
+	}
+	v1Manifest, _ := ParseManifest(v1Body, "")
+	if first.Size != v1.Size+v1Manifest.Config.Size+int64(len("shared layer")) {
+		t.Errorf("unexpected size of v1 %d", first.Size)
+	}
+	if second.Digest != Digest(body) || second.Layers != 2 || second.SharedLayers != 1 {
+		t.Errorf("unexpected summary of v2 %+v", second)
+	}
+	if len(second.Platforms) != 1 || second.Platforms[0] != "linux/arm64" {
+		t.Errorf("platform of v2 should be read from its config, got %v", second.Platforms)
+	}
+}
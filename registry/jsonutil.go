@@ -18,22 +18,19 @@ func PersistentToFile(m map[string]string, file string) error{
 	return nil
 }
 
+// ParseFromFile parse image pair from images.json, of any version
 func ParseFromFile(file string) (map[string]string,error){
-	bytes,err:=os.ReadFile(file)
+	index,err:=ParseImageIndexFromFile(file)
 	if err != nil {
 		return map[string]string{},err
 	}
-	var ret map[string]string
-	err=json.Unmarshal(bytes, &ret)
-	if err != nil {
-		return map[string]string{},err
-	}
-	return ret,nil
+	return index.Pairs(),nil
 }
 // ConfirmDaemonJson deal with /etc/docker/daemon.json, return true if modified the `daemon.json`
 //   - if not exist, write a basic insecure-registry config
 //   - if existed, confirm that insecure-registry `http://localhost:5000` is set, if not set, add it
-// also note that, this function should be called before instance start,as it'll not reboot the docker daemon
+// also note that, this function should be called before instance start,as it'll not reboot the docker daemon.
+// dump doesn't need it anymore, the registry instance is published on 127.0.0.1 which docker trusts by default
 func ConfirmDaemonJson() (bool,error){
 	configFile:="/etc/docker/daemon.json"
 
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// this section collects the images of kubernetes manifests, written by hand or rendered by `helm template`
+
+var (
+	// K8S_MANIFEST_EXTENSIONS are the extensions of the manifests read out of a directory
+	K8S_MANIFEST_EXTENSIONS = []string{".yaml", ".yml", ".json"}
+
+	// k8sContainerFields are the fields of a pod spec listing containers
+	k8sContainerFields = []string{"initContainers", "containers", "ephemeralContainers"}
+)
+
+// ParseImagesFromK8s return the images of the containers, init containers and ephemeral containers of the
+// workloads in the manifests at path, a file or a directory walked recursively. sorted, without duplicates
+func ParseImagesFromK8s(path string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if file != path && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if file == path || isK8sManifest(file) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		err = parseK8sManifest(file, seen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for image := range seen {
+		ret = append(ret, image)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func isK8sManifest(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range K8S_MANIFEST_EXTENSIONS {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// parseK8sManifest add the images of every document of file into seen
+func parseK8sManifest(file string, seen map[string]bool) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc interface{}
+		err = decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("manifest %s: %s", file, err.Error())
+		}
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		err = k8sObjectImages(object, seen)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %s", file, err.Error())
+		}
+	}
+}
+
+// k8sObjectImages add the images of the pod spec of object into seen, the items of a list are walked
+func k8sObjectImages(object map[string]interface{}, seen map[string]bool) error {
+	kind, _ := object["kind"].(string)
+	var spec interface{}
+	switch kind {
+	case "Pod":
+		spec = object["spec"]
+	case "PodTemplate":
+		spec = k8sField(object, "template", "spec")
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		spec = k8sField(object, "spec", "template", "spec")
+	case "CronJob":
+		spec = k8sField(object, "spec", "jobTemplate", "spec", "template", "spec")
+	default:
+		if !strings.HasSuffix(kind, "List") {
+			return nil
+		}
+		items, _ := object["items"].([]interface{})
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				err := k8sObjectImages(item, seen)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	podSpec, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	name, _ := k8sField(object, "metadata", "name").(string)
+	for _, field := range k8sContainerFields {
+		containers, _ := podSpec[field].([]interface{})
+		for _, container := range containers {
+			container, ok := container.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			image, _ := container["image"].(string)
+			image = strings.TrimSpace(image)
+			if image == "" {
+				continue
+			}
+			if _, err := ParseReference(image); err != nil {
+				return fmt.Errorf("%s %s: %s", kind, name, err.Error())
+			}
+			seen[image] = true
+		}
+	}
+	return nil
+}
+
+// k8sField return the value of the nested field of object, nil if it's missing
+func k8sField(object map[string]interface{}, fields ...string) interface{} {
+	var value interface{} = object
+	for _, field := range fields {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[field]
+	}
+	return value
+}
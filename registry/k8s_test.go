@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"os"
+	paths "path"
+	"reflect"
+	"testing"
+)
+
+func TestParseImagesFromK8s(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(paths.Join(dir, "charts", "templates"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeImageList(t, dir, "app.yaml", `
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: registry.internal/app-migrate:1.0
+      containers:
+        - name: app
+          image: registry.internal/app:1.0
+        - name: proxy
+          image: envoyproxy/envoy:v1.27.0
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  image: not-an-image
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - image: busybox:1.36
+`)
+	writeImageList(t, paths.Join(dir, "charts", "templates"), "list.json", `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"kind": "Pod", "metadata": {"name": "debug"}, "spec": {
+      "containers": [{"image": "busybox:1.36"}],
+      "ephemeralContainers": [{"image": "nicolaka/netshoot"}]}},
+    {"kind": "StatefulSet", "spec": {"template": {"spec": {"containers": [{"image": "redis:7"}]}}}}
+  ]
+}`)
+	writeImageList(t, dir, "README.md", "image: nginx\n")
+
+	images, err := ParseImagesFromK8s(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := []string{"busybox:1.36", "envoyproxy/envoy:v1.27.0", "nicolaka/netshoot", "redis:7",
+		"registry.internal/app-migrate:1.0", "registry.internal/app:1.0"}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("got %v, want %v", images, want)
+	}
+
+	images, err = ParseImagesFromK8s(paths.Join(dir, "charts", "templates", "list.json"))
+	if err != nil || len(images) != 3 {
+		t.Errorf("unexpected images of a single file %v, %v", images, err)
+	}
+
+	writeImageList(t, dir, "broken.yaml", "kind: Pod\nspec:\n  containers:\n    - image: \"{{ .Values.image }}\"\n")
+	if _, err := ParseImagesFromK8s(dir); err == nil {
+		t.Error("an unrendered template should be reported")
+	}
+}
@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// this section pins the references of an image list to the manifest digests they resolved to,
+// so a dump can be rebuilt from exactly the same images later
+
+var (
+	// LOCK_FILE_NAME is the name of the lockfile in an archive
+	LOCK_FILE_NAME = "images.lock"
+
+	// LOCK_FILE_VERSION is the version of the lockfile format. version 1 has the digests only
+	LOCK_FILE_VERSION = 2
+)
+
+// Lockfile maps every reference of a dump to the manifest digest it resolved to.
+// the digest is the one of the manifest list if the reference names a list. the platforms and the
+// per-image settings the dump was run with are recorded too, so a locked dump rebuilds the same archive
+type Lockfile struct {
+	// Version of the lockfile format
+	Version int `json:"version"`
+
+	// Images is reference => manifest digest, such as nginx:1.25 => sha256:...
+	Images map[string]string `json:"images"`
+
+	// Platforms kept out of the manifest lists, as dump --platform takes them: linux/amd64,linux/arm64 or all.
+	// empty if none were kept
+	Platforms string `json:"platforms,omitempty"`
+
+	// Platform the manifest lists were resolved to when no platforms were kept, such as linux/amd64.
+	// empty means the host platform
+	Platform string `json:"platform,omitempty"`
+
+	// Settings are the per-image settings of the image list shaping the archive, reference => settings.
+	// the images without any are left out
+	Settings map[string]LockedSettings `json:"settings,omitempty"`
+}
+
+// LockedSettings are the per-image settings of ImageSettings a lockfile records
+type LockedSettings struct {
+	// Platforms of the image, as Lockfile.Platforms
+	Platforms string `json:"platforms,omitempty"`
+
+	// Alias load restores the image as, see ImageSettings.Alias
+	Alias string `json:"alias,omitempty"`
+}
+
+// NewLockfile return the lockfile of the resolved references
+func NewLockfile(resolved map[string]string) *Lockfile {
+	images := make(map[string]string, len(resolved))
+	for image, digest := range resolved {
+		images[image] = digest
+	}
+	return &Lockfile{Version: LOCK_FILE_VERSION, Images: images}
+}
+
+// SetPlatforms record the platforms kept out of the manifest lists, all keeps every platform, and the platform
+// the lists are resolved to when none is kept
+func (l *Lockfile) SetPlatforms(platforms []Platform, all bool, platform Platform) {
+	l.Platforms = FormatPlatforms(platforms, all)
+	l.Platform = platform.String()
+}
+
+// SetSettings record the per-image settings of the locked images shaping the archive, image => settings
+func (l *Lockfile) SetSettings(settings map[string]ImageSettings) {
+	l.Settings = nil
+	for image, setting := range settings {
+		if _, ok := l.Images[image]; !ok {
+			continue
+		}
+		locked := LockedSettings{Platforms: FormatPlatforms(setting.Platforms, setting.AllPlatforms), Alias: setting.Alias}
+		if locked == (LockedSettings{}) {
+			continue
+		}
+		if l.Settings == nil {
+			l.Settings = make(map[string]LockedSettings)
+		}
+		l.Settings[image] = locked
+	}
+}
+
+// HasPlatforms return true if the lockfile records the platforms of the dump, the ones of version 1 don't
+func (l *Lockfile) HasPlatforms() bool {
+	return l.Version > 1
+}
+
+// PlatformsOf return the platforms kept out of the manifest lists, true if all of them, and the platform the lists
+// are resolved to when none is kept
+func (l *Lockfile) PlatformsOf() ([]Platform, bool, Platform, error) {
+	platforms, all, err := parsePlatformSelection(l.Platforms)
+	if err != nil {
+		return nil, false, Platform{}, err
+	}
+	if l.Platform == "" {
+		return platforms, all, HostPlatform(), nil
+	}
+	platform, err := ParsePlatform(l.Platform)
+	if err != nil {
+		return nil, false, Platform{}, err
+	}
+	return platforms, all, platform, nil
+}
+
+// ImageSettings return the recorded per-image settings, image => settings
+func (l *Lockfile) ImageSettings() (map[string]ImageSettings, error) {
+	ret := make(map[string]ImageSettings, len(l.Settings))
+	for image, locked := range l.Settings {
+		platforms, all, err := parsePlatformSelection(locked.Platforms)
+		if err != nil {
+			return nil, fmt.Errorf("image %s: %s", image, err.Error())
+		}
+		ret[image] = ImageSettings{Platforms: platforms, AllPlatforms: all, Alias: locked.Alias}
+	}
+	return ret, nil
+}
+
+// FormatPlatforms format the platforms as dump --platform takes them, PLATFORM_ALL if all is true
+func FormatPlatforms(platforms []Platform, all bool) string {
+	if all {
+		return PLATFORM_ALL
+	}
+	return platformsString(platforms)
+}
+
+// parsePlatformSelection parse the platforms formatted by FormatPlatforms
+func parsePlatformSelection(platforms string) ([]Platform, bool, error) {
+	if platforms == PLATFORM_ALL {
+		return nil, true, nil
+	}
+	if platforms == "" {
+		return nil, false, nil
+	}
+	ret, err := ParsePlatforms(platforms)
+	return ret, false, err
+}
+
+// References return the locked references in order
+func (l *Lockfile) References() []string {
+	ret := make([]string, 0, len(l.Images))
+	for image := range l.Images {
+		ret = append(ret, image)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// PersistentLockToFile persistent the lockfile into file, the references are sorted so
+// dumps of the same images write the same lockfile
+func PersistentLockToFile(lock *Lockfile, file string) error {
+	bytes, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(bytes, '\n'), 0644)
+}
+
+// ParseLockFromFile parse the lockfile from file, every reference must be pinned to a digest
+func ParseLockFromFile(file string) (*Lockfile, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lockfile{}
+	err = json.Unmarshal(bytes, lock)
+	if err != nil {
+		return nil, fmt.Errorf("lockfile %s: %s", file, err.Error())
+	}
+	if lock.Version < 1 || lock.Version > LOCK_FILE_VERSION {
+		return nil, fmt.Errorf("lockfile %s: unsupported version %d", file, lock.Version)
+	}
+	if len(lock.Images) == 0 {
+		return nil, fmt.Errorf("lockfile %s: no images", file)
+	}
+	for image, digest := range lock.Images {
+		if _, _, err := splitDigest(digest); err != nil {
+			return nil, fmt.Errorf("lockfile %s: image %s: %s", file, image, err.Error())
+		}
+	}
+	if lock.HasPlatforms() {
+		if _, _, _, err := lock.PlatformsOf(); err != nil {
+			return nil, fmt.Errorf("lockfile %s: %s", file, err.Error())
+		}
+		if _, err := lock.ImageSettings(); err != nil {
+			return nil, fmt.Errorf("lockfile %s: %s", file, err.Error())
+		}
+	}
+	return lock, nil
+}
@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+func TestNativeFetcher_Pins(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	v1, _ := remote.addImage("v1", "first layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1"
+
+	fetcher := NewDefaultNativeFetcher(t.TempDir())
+	err := fetcher.Fetch(context.Background(), image, "localhost:5000/app:v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lockfile := paths.Join(t.TempDir(), "dump.tar.gz.lock")
+	err = PersistentLockToFile(NewLockfile(fetcher.Resolved()), lockfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lock, err := ParseLockFromFile(lockfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if lock.Images[image] != v1.Digest {
+		t.Fatalf("%s is locked to %s, want %s", image, lock.Images[image], v1.Digest)
+	}
+
+	// the tag moves on, the locked dump still gets the first image
+	remote.addImage("v1", "second layer", nil)
+	dataPath := t.TempDir()
+	fetcher = NewDefaultNativeFetcher(dataPath)
+	fetcher.Pins = lock.Images
+	err = fetcher.Fetch(context.Background(), image, "localhost:5000/app:v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage := NewStorage(dataPath)
+	digest, err := storage.ResolveTag("app", "v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if digest != v1.Digest {
+		t.Errorf("tag v1 points to %s, want the locked %s", digest, v1.Digest)
+	}
+	if storage.HasBlob(Digest([]byte("second layer"))) {
+		t.Error("the layer of the moved tag should not be fetched")
+	}
+}
+
+func TestParseLockFromFile_Malformed(t *testing.T) {
+	lockfile := paths.Join(t.TempDir(), "images.lock")
+	err := PersistentLockToFile(NewLockfile(map[string]string{"nginx:1.25": "latest"}), lockfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ParseLockFromFile(lockfile); err == nil {
+		t.Error("a reference which isn't pinned to a digest should be refused")
+	}
+}
+
+func TestLockfile_Platforms(t *testing.T) {
+	digest := Digest([]byte("manifest"))
+	lock := NewLockfile(map[string]string{"nginx:1.25": digest, "cicd/app:v1": digest, "redis:7": digest})
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	lock.SetPlatforms([]Platform{amd64, arm64}, false, amd64)
+	lock.SetSettings(map[string]ImageSettings{
+		"nginx:1.25":  {AllPlatforms: true},
+		"cicd/app:v1": {Alias: "app:v1", PullPolicy: PULL_POLICY_ALWAYS},
+		"redis:7":     {PullPolicy: PULL_POLICY_ALWAYS},
+		"missing:v1":  {Alias: "other:v1"},
+	})
+	lockfile := paths.Join(t.TempDir(), "images.lock")
+	err := PersistentLockToFile(lock, lockfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lock, err = ParseLockFromFile(lockfile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	platforms, all, platform, err := lock.PlatformsOf()
+	if err != nil || !lock.HasPlatforms() || len(platforms) != 2 || platforms[1] != arm64 || all || platform != amd64 {
+		t.Errorf("the platforms of the dump should be recorded, got %v %v %v %v", platforms, all, platform, err)
+	}
+	settings, err := lock.ImageSettings()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(settings) != 2 || !settings["nginx:1.25"].AllPlatforms || settings["cicd/app:v1"].Alias != "app:v1" {
+		t.Errorf("only the settings shaping the archive of the locked images should be recorded, got %+v", settings)
+	}
+
+	// the lockfiles of version 1 only pin the digests
+	err = os.WriteFile(lockfile, []byte(`{"version":1,"images":{"nginx:1.25":"`+digest+`"}}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lock, err = ParseLockFromFile(lockfile)
+	if err != nil || lock.HasPlatforms() {
+		t.Errorf("a lockfile of version 1 should be read without platforms, got %+v %v", lock, err)
+	}
+}
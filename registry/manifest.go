@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// media types of the manifests understood by the native client
+const (
+	MEDIA_TYPE_DOCKER_MANIFEST      = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIA_TYPE_DOCKER_MANIFEST_LIST = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIA_TYPE_OCI_MANIFEST         = "application/vnd.oci.image.manifest.v1+json"
+	MEDIA_TYPE_OCI_INDEX            = "application/vnd.oci.image.index.v1+json"
+)
+
+// ManifestMediaTypes is the Accept list sent when fetching a manifest
+var ManifestMediaTypes = []string{
+	MEDIA_TYPE_DOCKER_MANIFEST_LIST,
+	MEDIA_TYPE_OCI_INDEX,
+	MEDIA_TYPE_DOCKER_MANIFEST,
+	MEDIA_TYPE_OCI_MANIFEST,
+}
+
+// PLATFORM_ALL selects every platform of a manifest list
+var PLATFORM_ALL = "all"
+
+// Platform describes the os and architecture an image is built for
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Descriptor points to a blob or a manifest by its digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest covers both image manifests (Config and Layers are set)
+// and manifest lists / image indexes (Manifests is set)
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        *Descriptor  `json:"config,omitempty"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	Manifests     []Descriptor `json:"manifests,omitempty"`
+}
+
+// IsIndexMediaType return true if the media type is a manifest list or an image index
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == MEDIA_TYPE_DOCKER_MANIFEST_LIST || mediaType == MEDIA_TYPE_OCI_INDEX
+}
+
+// ParseManifest decode the manifest body. the media type returned by the registry
+// is used when the body doesn't carry one
+func ParseManifest(body []byte, mediaType string) (*Manifest, error) {
+	m := &Manifest{}
+	err := json.Unmarshal(body, m)
+	if err != nil {
+		return nil, fmt.Errorf("malformed manifest: %s", err.Error())
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaType
+	}
+	if m.MediaType == "" && len(m.Manifests) != 0 {
+		m.MediaType = MEDIA_TYPE_OCI_INDEX
+	}
+	if m.SchemaVersion != 2 {
+		return nil, fmt.Errorf("unsupported manifest schema version %d", m.SchemaVersion)
+	}
+	return m, nil
+}
+
+// Blobs return the config and layers referenced by an image manifest
+func (m *Manifest) Blobs() []Descriptor {
+	ret := make([]Descriptor, 0, len(m.Layers)+1)
+	if m.Config != nil {
+		ret = append(ret, *m.Config)
+	}
+	return append(ret, m.Layers...)
+}
+
+// String format the platform as os/arch[/variant]
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+}
+
+// Matches return true if p satisfies the wanted platform, an empty variant matches any variant
+func (p Platform) Matches(want Platform) bool {
+	if p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == want.Variant
+}
+
+// ParsePlatform parse os/arch[/variant], such as linux/arm64 or linux/arm/v7
+func ParsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(strings.TrimSpace(platform), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("malformed platform %q, must be os/arch[/variant]", platform)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// ParsePlatforms parse a comma separated platform list
+func ParsePlatforms(platforms string) ([]Platform, error) {
+	ret := make([]Platform, 0)
+	for _, platform := range strings.Split(platforms, ",") {
+		if strings.TrimSpace(platform) == "" {
+			continue
+		}
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// HostPlatform is the platform `docker pull` resolves on this machine
+func HostPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if p.Architecture == "arm" {
+		p.Variant = "v7"
+	}
+	return p
+}
+
+// SelectPlatform pick the manifest matching platform from an index
+func (m *Manifest) SelectPlatform(platform Platform) (Descriptor, error) {
+	for _, desc := range m.Manifests {
+		if desc.Platform != nil && desc.Platform.Matches(platform) {
+			return desc, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for platform %s", platform.String())
+}
+
+// Digest calc the sha256 digest of content
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// splitDigest split sha256:<hex> into its algorithm and hex part
+func splitDigest(digest string) (string, string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(encoded) != 64 {
+		return "", "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return "", "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return algorithm, encoded, nil
+}
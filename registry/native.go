@@ -0,0 +1,313 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// this section copies images from remote registries straight into a registry data dir,
+// which replaces the docker pull => docker tag => docker push round-trip of dump
+
+// NativeFetcher fetch images with the registry client and write them into Storage
+type NativeFetcher struct {
+	// Client talks to the remote registries
+	Client *Client
+
+	// Storage receives the manifests and blobs
+	Storage ImageStore
+
+	// Parallelism indicates the number of go routine,default to the number of cpu core
+	Parallelism int
+
+	// FailFast stop fetching once an image failed, see runBatch
+	FailFast bool
+
+	// Retry is how the fetches failing transiently, such as on a 502 of the registry, are retried
+	Retry RetryPolicy
+
+	// Platform is resolved when an image is a manifest list, default to the host platform.
+	// it's ignored if Platforms or AllPlatforms is set
+	Platform Platform
+
+	// Platforms are kept when an image is a manifest list, along with the list itself
+	Platforms []Platform
+
+	// AllPlatforms keep every manifest of a manifest list
+	AllPlatforms bool
+
+	// Base is the blob set of a base archive, such blobs are not fetched
+	Base map[string]bool
+
+	// Settings are the per-image settings of a structured image list, image => settings.
+	// the platforms of an image override Platforms and AllPlatforms
+	Settings map[string]ImageSettings
+
+	// Pins are the manifest digests of a lockfile, image => digest. a pinned image is fetched
+	// by its digest instead of its tag
+	Pins map[string]string
+
+	lock sync.Mutex
+	// blobs of Base the fetched images refer to
+	required map[string]bool
+	// manifest digests the fetched images resolved to, image => digest
+	resolved map[string]string
+}
+
+// Fetch copy image into the storage, tagged as localTag
+func (f *NativeFetcher) Fetch(ctx context.Context, image string, localTag string) error {
+	remote, err := ParseReference(image)
+	if err != nil {
+		return err
+	}
+	local, err := ParseReference(localTag)
+	if err != nil {
+		return err
+	}
+	if local.Digest != "" {
+		return fmt.Errorf("local tag %s must not be a digest", localTag)
+	}
+	host, repo, ref, localRepo := remote.Domain, remote.Path, remote.Ref(), local.Path
+
+	if pin, ok := f.Pins[image]; ok {
+		ref = pin
+	}
+
+	log.Printf("fetching image %s ... \n", image)
+	body, mediaType, digest, err := f.Client.GetManifest(ctx, host, repo, ref)
+	if err != nil {
+		return err
+	}
+	f.resolve(image, digest)
+	m, err := ParseManifest(body, mediaType)
+	if err != nil {
+		return fmt.Errorf("image %s: %s", image, err.Error())
+	}
+	platforms, all := f.platformsOf(image)
+	if IsIndexMediaType(m.MediaType) && !all && len(platforms) == 0 {
+		// resolve the platform like `docker pull` does
+		desc, err := m.SelectPlatform(f.Platform)
+		if err != nil {
+			return fmt.Errorf("image %s: %s", image, err.Error())
+		}
+		body, mediaType, digest, err = f.Client.GetManifest(ctx, host, repo, desc.Digest)
+		if err != nil {
+			return err
+		}
+		m, err = ParseManifest(body, mediaType)
+		if err != nil {
+			return fmt.Errorf("image %s: %s", image, err.Error())
+		}
+	}
+
+	if IsIndexMediaType(m.MediaType) {
+		// keep the manifest list along with the manifests of the wanted platforms
+		fetched := make([]string, 0)
+		for _, desc := range m.Manifests {
+			if !wantsPlatform(desc.Platform, platforms, all) {
+				continue
+			}
+			err = f.fetchManifest(ctx, host, repo, localRepo, desc.Digest)
+			if err != nil {
+				return fmt.Errorf("image %s: %s", image, err.Error())
+			}
+			if desc.Platform != nil {
+				fetched = append(fetched, desc.Platform.String())
+			}
+		}
+		if len(fetched) == 0 {
+			return fmt.Errorf("image %s: no manifest for platform %s", image, platformsString(platforms))
+		}
+		log.Printf("image %s: fetched platforms %s \n", image, strings.Join(fetched, ","))
+	} else {
+		err = f.fetchBlobs(ctx, host, repo, localRepo, m)
+		if err != nil {
+			return fmt.Errorf("image %s: %s", image, err.Error())
+		}
+	}
+	err = f.putManifest(localRepo, digest, body)
+	if err != nil {
+		return err
+	}
+	err = f.Storage.Reference(image, localTag, Descriptor{MediaType: m.MediaType, Digest: digest, Size: int64(len(body))})
+	if err != nil {
+		return err
+	}
+	log.Printf("image %s fetched as %s, digest: %s \n", image, localTag, digest)
+	return nil
+}
+
+// fetchManifest fetch the image manifest digest and its blobs into localRepo
+func (f *NativeFetcher) fetchManifest(ctx context.Context, host string, repo string, localRepo string, digest string) error {
+	body, mediaType, _, err := f.Client.GetManifest(ctx, host, repo, digest)
+	if err != nil {
+		return err
+	}
+	m, err := ParseManifest(body, mediaType)
+	if err != nil {
+		return err
+	}
+	if IsIndexMediaType(m.MediaType) {
+		return fmt.Errorf("nested manifest list %s is not supported", digest)
+	}
+	err = f.fetchBlobs(ctx, host, repo, localRepo, m)
+	if err != nil {
+		return err
+	}
+	return f.putManifest(localRepo, digest, body)
+}
+
+// fetchBlobs fetch the config and layers of an image manifest and link them into localRepo
+func (f *NativeFetcher) fetchBlobs(ctx context.Context, host string, repo string, localRepo string, m *Manifest) error {
+	for _, blob := range m.Blobs() {
+		if !f.inBase(blob.Digest) {
+			err := f.fetchBlob(ctx, host, repo, blob.Digest)
+			if err != nil {
+				return err
+			}
+		}
+		err := f.Storage.LinkBlob(localRepo, blob.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putManifest store the manifest in localRepo, only linked if the base carries it
+func (f *NativeFetcher) putManifest(localRepo string, digest string, body []byte) error {
+	if f.inBase(digest) {
+		return f.Storage.LinkManifest(localRepo, digest)
+	}
+	return f.Storage.PutManifest(localRepo, digest, body)
+}
+
+// platformsOf return the platforms kept out of the manifest list of image, and true if it's all of them
+func (f *NativeFetcher) platformsOf(image string) ([]Platform, bool) {
+	if settings, ok := f.Settings[image]; ok && (settings.AllPlatforms || len(settings.Platforms) != 0) {
+		return settings.Platforms, settings.AllPlatforms
+	}
+	return f.Platforms, f.AllPlatforms
+}
+
+// wantsPlatform return true if the manifest of platform is kept, all keeps every manifest
+func wantsPlatform(platform *Platform, platforms []Platform, all bool) bool {
+	if all {
+		return true
+	}
+	if platform == nil {
+		return false
+	}
+	for _, want := range platforms {
+		if platform.Matches(want) {
+			return true
+		}
+	}
+	return false
+}
+
+func platformsString(platforms []Platform) string {
+	list := make([]string, 0, len(platforms))
+	for _, p := range platforms {
+		list = append(list, p.String())
+	}
+	return strings.Join(list, ",")
+}
+
+func (f *NativeFetcher) fetchBlob(ctx context.Context, host string, repo string, digest string) error {
+	if f.Storage.HasBlob(digest) {
+		return nil
+	}
+	reader, _, err := f.Client.GetBlob(ctx, host, repo, digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return f.Storage.WriteBlob(digest, reader)
+}
+
+// inBase return true if the base carries the blob, which is recorded as required
+func (f *NativeFetcher) inBase(digest string) bool {
+	if !f.Base[digest] {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.required == nil {
+		f.required = make(map[string]bool)
+	}
+	f.required[digest] = true
+	return true
+}
+
+// resolve record the manifest digest image resolved to
+func (f *NativeFetcher) resolve(image string, digest string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.resolved == nil {
+		f.resolved = make(map[string]string)
+	}
+	f.resolved[image] = digest
+}
+
+// Resolved return the manifest digests the fetched images resolved to, image => digest.
+// it's the digest of the manifest list if an image names one
+func (f *NativeFetcher) Resolved() map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := make(map[string]string, len(f.resolved))
+	for image, digest := range f.resolved {
+		ret[image] = digest
+	}
+	return ret
+}
+
+// Required return the blobs of Base the fetched images refer to
+func (f *NativeFetcher) Required() map[string]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	ret := make(map[string]bool, len(f.required))
+	for digest := range f.required {
+		ret[digest] = true
+	}
+	return ret
+}
+
+// FetchAll fetch all images pair (remote => local tag) in a multi-go-routine.
+// each go routine fetch one item at a time from work queue
+func (f *NativeFetcher) FetchAll(ctx context.Context, images map[string]string) error {
+	items := make([]string, 0, len(images))
+	for k := range images {
+		items = append(items, k)
+	}
+	sort.Strings(items)
+	results := runBatch(ctx, "fetch", items, f.Parallelism, f.FailFast, 0, f.Retry, func(ctx context.Context, image string) error {
+		return f.Fetch(ctx, image, images[image])
+	})
+	return results.Err("fetch")
+}
+
+// splitRemoteImage split a well-formed image into registry host, repository and tag or digest,
+// see ParseReference. user input is checked by ParseReference first, a malformed image yields empty parts
+func splitRemoteImage(image string) (string, string, string) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", "", ""
+	}
+	return ref.Domain, ref.Path, ref.Ref()
+}
+
+// NewDefaultNativeFetcher return a fetcher writing into the registry data dir dataPath
+func NewDefaultNativeFetcher(dataPath string) *NativeFetcher {
+	return &NativeFetcher{
+		Client:      NewDefaultClient(),
+		Storage:     NewStorage(dataPath),
+		Parallelism: runtime.NumCPU(),
+		Platform:    HostPlatform(),
+		Retry:       NewDefaultRetryPolicy(),
+	}
+}
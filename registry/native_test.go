@@ -0,0 +1,296 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	paths "path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRemote serves manifests and blobs of a single repository behind token auth
+type fakeRemote struct {
+	repo      string
+	manifests map[string][]byte // by tag and digest
+	types     map[string]string
+	blobs     map[string][]byte
+	failures  int32 // manifest requests answered by a 502 before the manifests are served
+}
+
+func newFakeRemote(repo string) *fakeRemote {
+	return &fakeRemote{
+		repo:      repo,
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		blobs:     make(map[string][]byte),
+	}
+}
+
+// addImage add an image manifest with a config and one layer, return its digest
+func (f *fakeRemote) addImage(tag string, layer string, platform *Platform) (Descriptor, []byte) {
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","layer":%q}`, layer))
+	f.blobs[Digest(config)] = config
+	f.blobs[Digest([]byte(layer))] = []byte(layer)
+	m := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MEDIA_TYPE_DOCKER_MANIFEST,
+		Config:        &Descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: Digest(config), Size: int64(len(config))},
+		Layers:        []Descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: Digest([]byte(layer)), Size: int64(len(layer))}},
+	}
+	body, _ := json.Marshal(m)
+	desc := Descriptor{MediaType: MEDIA_TYPE_DOCKER_MANIFEST, Digest: Digest(body), Size: int64(len(body)), Platform: platform}
+	f.addManifest(tag, desc.Digest, body, MEDIA_TYPE_DOCKER_MANIFEST)
+	return desc, body
+}
+
+// addIndex add a manifest list of the descriptors, return its digest
+func (f *fakeRemote) addIndex(tag string, descs ...Descriptor) string {
+	body, _ := json.Marshal(Manifest{SchemaVersion: 2, MediaType: MEDIA_TYPE_DOCKER_MANIFEST_LIST, Manifests: descs})
+	f.addManifest(tag, Digest(body), body, MEDIA_TYPE_DOCKER_MANIFEST_LIST)
+	return Digest(body)
+}
+
+func (f *fakeRemote) addManifest(tag string, digest string, body []byte, mediaType string) {
+	for _, ref := range []string{tag, digest} {
+		if ref == "" {
+			continue
+		}
+		f.manifests[ref] = body
+		f.types[ref] = mediaType
+	}
+}
+
+func (f *fakeRemote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if !strings.Contains(req.URL.Query().Get("scope"), "repository:"+f.repo+":") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"secret"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.Contains(req.URL.Path, "/manifests/") && atomic.AddInt32(&f.failures, -1) >= 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	prefix := "/v2/" + f.repo + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kind, ref, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	switch kind {
+	case "manifests":
+		body, ok := f.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[ref])
+		w.Write(body)
+	case "blobs":
+		body, ok := f.blobs[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSplitRemoteImage(t *testing.T) {
+	cases := map[string][3]string{
+		"busybox":                                   {"docker.io", "library/busybox", "latest"},
+		"nginx:1.25":                                {"docker.io", "library/nginx", "1.25"},
+		"bitnami/redis:7":                           {"docker.io", "bitnami/redis", "7"},
+		"registry.geoway.com/cicd/jenkins:v1":       {"registry.geoway.com", "cicd/jenkins", "v1"},
+		"localhost:5000/busybox":                    {"localhost:5000", "busybox", "latest"},
+		"registry:5000/app:1.0":                     {"registry:5000", "app", "1.0"},
+		"busybox@sha256:" + strings.Repeat("a", 64): {"docker.io", "library/busybox", "sha256:" + strings.Repeat("a", 64)},
+	}
+	for image, want := range cases {
+		host, repo, ref := splitRemoteImage(image)
+		if [3]string{host, repo, ref} != want {
+			t.Errorf("%s: got %s %s %s, want %v", image, host, repo, ref, want)
+		}
+	}
+}
+
+func TestNativeFetcher_Fetch(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	amd64, _ := remote.addImage("", "amd64 layer", &Platform{OS: "linux", Architecture: "amd64"})
+	arm64, _ := remote.addImage("", "arm64 layer", &Platform{OS: "linux", Architecture: "arm64"})
+	remote.addIndex("v1", amd64, arm64)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dataPath := t.TempDir()
+	fetcher := NewDefaultNativeFetcher(dataPath)
+	fetcher.Platform = Platform{OS: "linux", Architecture: "arm64"}
+	err := fetcher.FetchAll(context.Background(), map[string]string{
+		host + "/cicd/app:v1": "localhost:5000/app:v1",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	root := paths.Join(dataPath, REGISTRY_STORAGE_ROOT)
+	link, err := os.ReadFile(paths.Join(root, "repositories/app/_manifests/tags/v1/current/link"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(link) != arm64.Digest {
+		t.Errorf("tag v1 points to %s, want the arm64 manifest %s", link, arm64.Digest)
+	}
+	if !fetcher.Storage.HasBlob(Digest([]byte("arm64 layer"))) {
+		t.Error("arm64 layer is not fetched")
+	}
+	if fetcher.Storage.HasBlob(Digest([]byte("amd64 layer"))) {
+		t.Error("amd64 layer should not be fetched")
+	}
+	_, err = os.Stat(paths.Join(root, "repositories/app/_layers/sha256", strings.TrimPrefix(Digest([]byte("arm64 layer")), "sha256:"), "link"))
+	if err != nil {
+		t.Error("layer is not linked into the repository:", err.Error())
+	}
+}
+
+func TestNativeFetcher_FetchPlatforms(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	amd64, _ := remote.addImage("", "amd64 layer", &Platform{OS: "linux", Architecture: "amd64"})
+	arm64, _ := remote.addImage("", "arm64 layer", &Platform{OS: "linux", Architecture: "arm64"})
+	armv7, _ := remote.addImage("", "armv7 layer", &Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	list := remote.addIndex("v1", amd64, arm64, armv7)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dataPath := t.TempDir()
+	fetcher := NewDefaultNativeFetcher(dataPath)
+	fetcher.Platforms, _ = ParsePlatforms("linux/amd64,linux/arm64")
+	err := fetcher.FetchAll(context.Background(), map[string]string{
+		host + "/cicd/app:v1": "localhost:5000/app:v1",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	storage := NewStorage(dataPath)
+	digest, err := storage.ResolveTag("app", "v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if digest != list {
+		t.Errorf("tag v1 points to %s, want the manifest list %s", digest, list)
+	}
+	for _, layer := range []string{"amd64 layer", "arm64 layer"} {
+		if !storage.HasLinkedBlob("app", Digest([]byte(layer))) {
+			t.Errorf("%s is not fetched", layer)
+		}
+	}
+	if storage.HasBlob(Digest([]byte("armv7 layer"))) {
+		t.Error("armv7 layer should not be fetched")
+	}
+	platforms, err := storage.Platforms("app", "v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(platforms) != 2 || platforms[0].String() != "linux/amd64" || platforms[1].String() != "linux/arm64" {
+		t.Errorf("got platforms %v, want linux/amd64 and linux/arm64", platforms)
+	}
+	err = checkPlatform(storage, map[string]string{"app:v1": "localhost:5000/app:v1"}, Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	if err == nil {
+		t.Error("a platform left out by dump should be refused by load")
+	}
+
+	fetcher = NewDefaultNativeFetcher(t.TempDir())
+	fetcher.Platforms, _ = ParsePlatforms("linux/s390x")
+	err = fetcher.Fetch(context.Background(), host+"/cicd/app:v1", "localhost:5000/app:v1")
+	if err == nil {
+		t.Error("a manifest list without the platform should fail")
+	}
+}
+
+func TestParsePlatforms(t *testing.T) {
+	platforms, err := ParsePlatforms("linux/amd64, linux/arm/v7")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(platforms) != 2 || platforms[1] != (Platform{OS: "linux", Architecture: "arm", Variant: "v7"}) {
+		t.Errorf("got %v", platforms)
+	}
+	for _, malformed := range []string{"linux", "linux/", "linux/arm/v7/x"} {
+		if _, err := ParsePlatforms(malformed); err == nil {
+			t.Errorf("%s should be malformed", malformed)
+		}
+	}
+}
+
+func TestStorage_WriteBlobMismatch(t *testing.T) {
+	storage := NewStorage(t.TempDir())
+	err := storage.WriteBlob(Digest([]byte("expected")), strings.NewReader("actual"))
+	if err == nil {
+		t.Error("digest mismatch should fail")
+	}
+	if storage.HasBlob(Digest([]byte("expected"))) {
+		t.Error("corrupted blob should not be kept")
+	}
+}
+
+func TestNativeFetcher_Retry(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	remote.addImage("v1", "layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	images := map[string]string{strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1": "localhost:5000/app:v1"}
+
+	fetcher := NewDefaultNativeFetcher(t.TempDir())
+	fetcher.Retry = RetryPolicy{Retries: 0}
+	remote.failures = 1
+	if err := fetcher.FetchAll(context.Background(), images); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("a 502 should fail the fetch without retries, got %v", err)
+	}
+	fetcher.Retry = RetryPolicy{Retries: 3, Delay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	remote.failures = 2
+	if err := fetcher.FetchAll(context.Background(), images); err != nil {
+		t.Errorf("the fetch should be retried past the 502s, got %s", err.Error())
+	}
+}
+
+func TestNativeRegistry_DumpCanceled(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	remote.addImage("v1", "layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1"
+
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reg := NewNativeRegistryWithImagesPredefined(map[string]string{image: "localhost:5000/app:v1"},
+		append(NewDefaultOptions(), WithWorkDir(dir))...)
+	err := reg.Dump(ctx, paths.Join(dir, "dump.tar.gz"))
+	if err == nil {
+		t.Fatal("a canceled dump should fail")
+	}
+	staging, _ := filepath.Glob(paths.Join(dir, STAGING_DIR_PREFIX+"*"))
+	for _, left := range append(staging, paths.Join(dir, "dump.tar.gz")) {
+		if _, err := os.Stat(left); err == nil {
+			t.Errorf("%s should be cleaned up", left)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	paths "path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// OCI_LAYOUT_VERSION is the imageLayoutVersion written to oci-layout
+	OCI_LAYOUT_VERSION = "1.0.0"
+
+	// ANNOTATION_REF_NAME names the image of an index.json entry
+	ANNOTATION_REF_NAME = "org.opencontainers.image.ref.name"
+
+	// ANNOTATION_CONTAINERD_IMAGE_NAME is the fully qualified name `ctr images import` restores
+	ANNOTATION_CONTAINERD_IMAGE_NAME = "io.containerd.image.name"
+)
+
+// ImageStore receives the manifests and blobs fetched by NativeFetcher
+type ImageStore interface {
+	// HasBlob return true if the blob content is present
+	HasBlob(digest string) bool
+
+	// WriteBlob write the content of r as blob digest, the content must match the digest
+	WriteBlob(digest string, r io.Reader) error
+
+	// LinkBlob make an existing blob part of repo
+	LinkBlob(repo string, digest string) error
+
+	// PutManifest store the manifest body in repo
+	PutManifest(repo string, digest string, body []byte) error
+
+	// LinkManifest make the manifest part of repo without storing its content
+	LinkManifest(repo string, digest string) error
+
+	// Reference record the manifest desc as the image, stored under localTag
+	Reference(image string, localTag string, desc Descriptor) error
+}
+
+// Reference tag the manifest in the repository of localTag
+func (s *Storage) Reference(image string, localTag string, desc Descriptor) error {
+	_, repo, tag := splitRemoteImage(localTag)
+	return s.Tag(repo, tag, desc.Digest)
+}
+
+// OCILayout writes images into an OCI image layout directory:
+//   - oci-layout: the layout version
+//   - index.json: one entry per image, named by the org.opencontainers.image.ref.name annotation
+//   - blobs/sha256/<hex>: content of every layer, config and manifest
+type OCILayout struct {
+	root string
+
+	lock sync.Mutex
+	// index entries by image
+	manifests map[string]Descriptor
+}
+
+// NewOCILayout return the image layout rooted at root
+func NewOCILayout(root string) *OCILayout {
+	return &OCILayout{
+		root:      root,
+		manifests: make(map[string]Descriptor),
+	}
+}
+
+// HasBlob return true if the blob content is present
+func (l *OCILayout) HasBlob(digest string) bool {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// WriteBlob write the content of r as blob digest, verified against the digest
+func (l *OCILayout) WriteBlob(digest string, r io.Reader) error {
+	path, err := l.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	return writeVerified(path, digest, r)
+}
+
+// LinkBlob does nothing, blobs of a layout are shared by all images
+func (l *OCILayout) LinkBlob(repo string, digest string) error {
+	return nil
+}
+
+// PutManifest store the manifest body as a blob
+func (l *OCILayout) PutManifest(repo string, digest string, body []byte) error {
+	if l.HasBlob(digest) {
+		return nil
+	}
+	return l.WriteBlob(digest, bytes.NewReader(body))
+}
+
+// LinkManifest does nothing, manifests of a layout are only referenced by index.json
+func (l *OCILayout) LinkManifest(repo string, digest string) error {
+	return nil
+}
+
+// Reference add an index.json entry of image, annotated with the original reference
+func (l *OCILayout) Reference(image string, localTag string, desc Descriptor) error {
+	host, repo, ref := splitRemoteImage(image)
+	separator := ":"
+	if _, _, err := splitDigest(ref); err == nil {
+		separator = "@"
+	}
+	desc.Annotations = map[string]string{
+		ANNOTATION_REF_NAME:              image,
+		ANNOTATION_CONTAINERD_IMAGE_NAME: host + "/" + repo + separator + ref,
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.manifests[image] = desc
+	return nil
+}
+
+// WriteIndex write oci-layout and index.json, it's called after all images are fetched
+func (l *OCILayout) WriteIndex() error {
+	err := os.MkdirAll(l.root, 0755)
+	if err != nil {
+		return err
+	}
+	layout, _ := json.Marshal(map[string]string{"imageLayoutVersion": OCI_LAYOUT_VERSION})
+	err = os.WriteFile(paths.Join(l.root, "oci-layout"), layout, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	images := make([]string, 0, len(l.manifests))
+	for image := range l.manifests {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	index := Manifest{
+		SchemaVersion: 2,
+		MediaType:     MEDIA_TYPE_OCI_INDEX,
+		Manifests:     make([]Descriptor, 0, len(images)),
+	}
+	for _, image := range images {
+		index.Manifests = append(index.Manifests, l.manifests[image])
+	}
+	l.lock.Unlock()
+
+	body, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(paths.Join(l.root, "index.json"), body, 0644)
+}
+
+func (l *OCILayout) blobPath(digest string) (string, error) {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	return paths.Join(l.root, "blobs", "sha256", encoded), nil
+}
+
+// IsOCIArchive return true if the tar.gz archive is an OCI image layout, which starts with oci-layout
+func IsOCIArchive(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return false, err
+	}
+	header, err := tar.NewReader(gz).Next()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimPrefix(header.Name, "./") == "oci-layout", nil
+}
@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+func TestOCILayout(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	desc, _ := remote.addImage("v1", "layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1"
+
+	root := t.TempDir()
+	layout := NewOCILayout(root)
+	fetcher := NewDefaultNativeFetcher("")
+	fetcher.Storage = layout
+	err := fetcher.FetchAll(context.Background(), map[string]string{image: "localhost:5000/app:v1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = layout.WriteIndex()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	content, err := os.ReadFile(paths.Join(root, "index.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	index, err := ParseManifest(content, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != desc.Digest {
+		t.Fatalf("unexpected index %s", content)
+	}
+	if name := index.Manifests[0].Annotations[ANNOTATION_REF_NAME]; name != image {
+		t.Errorf("ref name is %s, want %s", name, image)
+	}
+	if strings.Contains(string(content), `"config"`) {
+		t.Error("index.json should not carry a config")
+	}
+	for _, digest := range []string{desc.Digest, Digest([]byte("layer"))} {
+		if !layout.HasBlob(digest) {
+			t.Errorf("blob %s is missing", digest)
+		}
+	}
+	var version map[string]string
+	content, _ = os.ReadFile(paths.Join(root, "oci-layout"))
+	if json.Unmarshal(content, &version); version["imageLayoutVersion"] != OCI_LAYOUT_VERSION {
+		t.Errorf("unexpected oci-layout %s", content)
+	}
+
+	archive := paths.Join(t.TempDir(), "oci.tar.gz")
+	err = TarCompressDirTo(context.Background(), archive, root, "oci-layout", "index.json", "blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	oci, err := IsOCIArchive(archive)
+	if err != nil || !oci {
+		t.Errorf("archive should be recognized as an OCI layout, err: %v", err)
+	}
+}
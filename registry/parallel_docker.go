@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 var (
@@ -18,7 +18,7 @@ type ParallelDocker struct {
 	Parallelism int
 
 	// Images record the images list or images pair.
-	// the relationship of k and v is usually remote-local (e.g. example.com/busybox:v1 => localhost:5000/busybox:v1)
+	// the relationship of k and v is usually remote-local (e.g. example.com/busybox:v1 => localhost:5000/example.com/busybox:v1)
 	Images map[string]string
 
 	//if PairMode is false, only key of Images take effect.
@@ -28,217 +28,101 @@ type ParallelDocker struct {
 
 	Pusher Pusher
 
-	workqueue Queue
-}
-// PullImages pull all images in a multi-go-routine. each go routine fetch one item at a time from work queue
-func(p *ParallelDocker) PullImages(k bool) error{
-	var wg sync.WaitGroup
-	wg.Add(len(p.Images))
-
-	if k {
-		// add all images to work queue
-		p.loadQueue(true,false,false,false)
-	}else {
-		p.loadQueue(false,true,false,false)
-	}
+	Tagger Tagger
 
+	// PullPolicies is image => pull policy, images are pulled whether present or not if absent
+	PullPolicies map[string]string
 
-	errResult := make([]error,0)
-	errResultLock:=sync.Mutex{}
-
-
-	imagePull:= func() {
-		// forever fetch a new image to pull,util workqueue return nil
-		for{
-
-			ctx,cancel:=context.WithTimeout(context.Background(),PULL_TIMEOUT_MINUTE)
-			defer cancel()
-			imageUntyped :=p.workqueue.Dequeue()
-			if imageUntyped == nil{
-				return
-			}
-			image:=imageUntyped.(string)
-			fmt.Printf("pulling image %s \n",image)
-			err := p.Puller.Pull(ctx, image)
-			if err != nil {
-				fmt.Printf("image %s pulling failed. \n",image)
-				errResultLock.Lock()
-				errResult=append(errResult,err) // mark the errResult
-				errResultLock.Unlock()
-				wg.Done() // mark it as finished, even the result is failed
-				return
-			}
-			wg.Done() // mark it as success
-		}
-	}
-	// pull the images
-	p.parallelRun(imagePull)
-	wg.Wait()
+	// FailFast skip the images not started yet once an image failed, and cancel the running ones.
+	// otherwise every image is run whatever the others become
+	FailFast bool
 
-	// check err
-	if len(errResult) !=0{
-		return SummaryError(errResult)
-	}
-	return nil
+	// Retry is how the pulls, pushes and retags failing transiently are retried
+	Retry RetryPolicy
 }
-
-func(p *ParallelDocker) PushImages() error{
-	if !p.PairMode {
-		return fmt.Errorf("you can't push with pair mode disabled")
-	}
-	var wg sync.WaitGroup
-	wg.Add(len(p.Images))
-
-	// add all images to work queue
-	p.loadQueue(false,true,false,false)
-
-	errResult := make([]error,0)
-	errResultLock:=sync.Mutex{}
-
-
-	imagePush:= func() {
-		// forever fetch a new image to pull,util workqueue return nil
-		for{
-			ctx,cancel:=context.WithTimeout(context.Background(),PULL_TIMEOUT_MINUTE)
-			defer cancel()
-			imageUntyped :=p.workqueue.Dequeue()
-			if imageUntyped == nil{
-				return
-			}
-			image:=imageUntyped.(string)
-			err := p.Pusher.Push(ctx, image)
-			if err != nil {
-				fmt.Printf("image %s push failed. \n",image)
-				errResultLock.Lock()
-				errResult=append(errResult,err) // mark the errResult
-				errResultLock.Unlock()
-				wg.Done() // mark it as finished, even the result is failed
-				return
-			}
-			wg.Done() // mark it as success
-		}
-	}
-	// push the images
-
-	p.parallelRun(imagePush)
-	wg.Wait()
-
-	// check err
-	if len(errResult) !=0{
-		return SummaryError(errResult)
-	}
-
-	return nil
+// PullImages pull the keys of Images if k is true, otherwise the values, see run
+func(p *ParallelDocker) PullImages(ctx context.Context,k bool) (Results,error){
+	results:=p.run(ctx,"pull",p.items(k,!k,false,false),p.pull)
+	return results,results.Err("pull")
 }
 
-func(p *ParallelDocker) RetagImages(kTov bool) error{
-	var wg sync.WaitGroup
-	wg.Add(len(p.Images))
-
-	// add all images to work queue
-	if kTov {
-		p.loadQueue(false,false,true,false)
-	}else{
-		p.loadQueue(false,false,false,true)
-	}
-
-	errResult := make([]error,0)
-	errResultLock:=sync.Mutex{}
-
-
-	imageRetag:= func() {
-		// forever fetch a new image to pull,util workqueue return nil
-		for{
-			imageUntyped :=p.workqueue.Dequeue()
-			if imageUntyped == nil{
-				return
-			}
-			image:=imageUntyped.(string)
-			err := RetagOne(image)
-			if err != nil {
-				fmt.Printf("image %s retag failed. \n",image)
-				errResultLock.Lock()
-				errResult=append(errResult,err) // mark the errResult
-				errResultLock.Unlock()
-				wg.Done() // mark it as finished, even the result is failed
-				return
-			}
-			wg.Done() // mark it as success
+// pull the image unless its pull policy lets the present one be used
+func(p *ParallelDocker) pull(ctx context.Context,image string) error{
+	policy:=p.PullPolicies[image]
+	if policy == PULL_POLICY_IFNOTPRESENT || policy == PULL_POLICY_NEVER {
+		present,err:=p.Puller.CheckIfPresent(ctx,image)
+		if err != nil {
+			return err
 		}
-	}
-	// retag the images
-	p.parallelRun(imageRetag)
-	wg.Wait()
-
-	// check err
-	if len(errResult) !=0{
-		return SummaryError(errResult)
-	}
-
-	return nil
-}
-
-
-func(p *ParallelDocker) loadQueue(k bool,v bool, kv bool, vk bool){
-	if k {
-		// add all images to work queue
-		for k, _:=range p.Images{
-			// not handle err, cause map can guard type assertion
-			_ = p.workqueue.Enqueue(k)
+		if present {
+			fmt.Printf("image %s is present, not pulled as its pull policy is %s \n",image,policy)
+			return nil
 		}
-		return
-	}
-	if v{
-		// add all images to work queue
-		for _, v:=range p.Images{
-			// not handle err, cause map can guard type assertion
-			_ = p.workqueue.Enqueue(v)
+		if policy == PULL_POLICY_NEVER {
+			return fmt.Errorf("image %s is not present and its pull policy is %s",image,policy)
 		}
-		return
 	}
+	fmt.Printf("pulling image %s \n",image)
+	return p.Puller.Pull(ctx, image)
+}
 
-	if kv || vk{
-		// add all images to work queue
-		for k, v:=range p.Images{
-			if kv{
-				// not handle err, cause map can guard type assertion
-				_ = p.workqueue.Enqueue(fmt.Sprintf("%s %s",k,v))
-				continue
-			}
-			if vk{
-				// not handle err, cause map can guard type assertion
-				_ = p.workqueue.Enqueue(fmt.Sprintf("%s %s",v,k))
-				continue
-			}
-		}
-		return
+// PushImages push the values of Images, see run
+func(p *ParallelDocker) PushImages(ctx context.Context) (Results,error){
+	if !p.PairMode {
+		return nil,fmt.Errorf("you can't push with pair mode disabled")
 	}
-
-
+	results:=p.run(ctx,"push",p.items(false,true,false,false),p.Pusher.Push)
+	return results,results.Err("push")
 }
-func(p *ParallelDocker) parallelRun(task func()){
-	for i := 0; i < p.Parallelism; i++ {
-		go task()
-	}
+
+// RetagImages tag every key of Images as its value if kTov is true, otherwise every value as its key, see run
+func(p *ParallelDocker) RetagImages(ctx context.Context,kTov bool) (Results,error){
+	results:=p.run(ctx,"retag",p.items(false,false,kTov,!kTov),func(ctx context.Context,pair string) error{
+		images:=strings.SplitN(pair," ",2)
+		return p.Tagger.Tag(ctx,images[0],images[1])
+	})
+	return results,results.Err("retag")
 }
 
+// run the task of every item, retried as Retry says, see runBatch. the running tasks are canceled once ctx is done
+func(p *ParallelDocker) run(ctx context.Context,action string,items []string,task func(ctx context.Context,item string) error) Results{
+	return runBatch(ctx,action,items,p.Parallelism,p.FailFast,PULL_TIMEOUT_MINUTE,p.Retry,task)
+}
 
-func SummaryError(errs []error) error {
-	list:=make([]string,0)
-	for _,err:=range errs{
-		list=append(list,err.Error())
+// items return the keys of Images if k is true, the values if v is true, or the `key value` pairs if kv
+// is true, the `value key` pairs if vk is true. sorted
+func(p *ParallelDocker) items(k bool,v bool, kv bool, vk bool) []string{
+	ret:=make([]string,0,len(p.Images))
+	for key,value:=range p.Images{
+		switch {
+		case k:
+			ret=append(ret,key)
+		case v:
+			ret=append(ret,value)
+		case kv:
+			ret=append(ret,fmt.Sprintf("%s %s",key,value))
+		case vk:
+			ret=append(ret,fmt.Sprintf("%s %s",value,key))
+		}
 	}
-	return fmt.Errorf("[%s]",strings.Join(list,","))
+	sort.Strings(ret)
+	return ret
 }
 
 
 func NewDefaultParallelDocker(images map[string]string,pairMode bool) *ParallelDocker {
+	return NewParallelDockerWithRuntime(images,pairMode,NewDefaultRuntime())
+}
+
+// NewParallelDockerWithRuntime return a ParallelDocker pulling, pushing and tagging through rt
+func NewParallelDockerWithRuntime(images map[string]string,pairMode bool,rt Runtime) *ParallelDocker {
 	return &ParallelDocker{
 		Images: images,
 		Parallelism: runtime.NumCPU() ,
 		PairMode: pairMode,
-		Puller: NewDefaultPuller(),
-		Pusher: NewDefaultPusher(),
-		workqueue: NewDefaultQueue(),
+		Puller: rt,
+		Pusher: rt,
+		Tagger: rt,
+		Retry: NewDefaultRetryPolicy(),
 	}
 }
\ No newline at end of file
@@ -1,6 +1,14 @@
 package registry
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestParallelDocker_PullImages(t *testing.T) {
 
@@ -10,7 +18,7 @@ func TestParallelDocker_PullImages(t *testing.T) {
 		"alpine:latest":"",
 	}
 	multiThreadPuller:=NewDefaultParallelDocker(m,false)
-	err:=multiThreadPuller.PullImages(true)
+	_,err:=multiThreadPuller.PullImages(context.Background(),true)
 	if err != nil {
 		t.Error("err:",err.Error())
 	}
@@ -23,7 +31,7 @@ func TestParallelDocker_PushImages(t *testing.T) {
 		"alpine:latest":"alpine:latest",
 	}
 	multiThreadPuller:=NewDefaultParallelDocker(m,true)
-	err:=multiThreadPuller.PushImages()
+	_,err:=multiThreadPuller.PushImages(context.Background())
 	if err != nil {
 		t.Error("err:",err.Error())
 	}
@@ -37,8 +45,130 @@ func TestParallelDocker_RetagImages(t *testing.T) {
 		"alpine:latest":"localhost:5000/alpine:latest",
 	}
 	multiThreadPuller:=NewDefaultParallelDocker(m,true)
-	err:=multiThreadPuller.RetagImages(true)
+	_,err:=multiThreadPuller.RetagImages(context.Background(),true)
 	if err != nil {
 		t.Error("err:",err.Error())
 	}
-}
\ No newline at end of file
+}
+
+// fakePuller fail the images of failing after failAfter, and the first pulls of the images of flaky
+// transiently, the others succeed after delay
+type fakePuller struct {
+	failing map[string]bool
+	flaky map[string]int
+	failAfter time.Duration
+	delay time.Duration
+	lock sync.Mutex
+	pulled []string
+}
+
+func (f *fakePuller) Pull(ctx context.Context,image string) error{
+	f.lock.Lock()
+	f.pulled=append(f.pulled,image)
+	flaky:=f.flaky[image] > 0
+	if flaky {
+		f.flaky[image]--
+	}
+	f.lock.Unlock()
+	if flaky {
+		return errors.New("received unexpected HTTP status: 502 Bad Gateway")
+	}
+	if f.failing[image] {
+		time.Sleep(f.failAfter)
+		return errors.New("manifest unknown")
+	}
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakePuller) CheckIfPresent(ctx context.Context,image string) (bool,error){
+	return false,nil
+}
+
+func TestParallelDocker_KeepGoing(t *testing.T) {
+	m:=make(map[string]string)
+	failing:=make(map[string]bool)
+	for i:=0;i<10;i++{
+		image:=fmt.Sprintf("app%d:v1",i)
+		m[image]=""
+		// every worker fails once at least
+		failing[image]=i%2 == 0
+	}
+	puller:=&fakePuller{failing:failing}
+	pd:=NewDefaultParallelDocker(m,false)
+	pd.Parallelism=2
+	pd.Puller=puller
+
+	done:=make(chan struct{})
+	var results Results
+	var err error
+	go func(){
+		results,err=pd.PullImages(context.Background(),true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10*time.Second):
+		t.Fatal("the workers should go on after a failure")
+	}
+	if len(puller.pulled) != 10 || results.Count(STATUS_SUCCEEDED) != 5 || results.Count(STATUS_FAILED) != 5 {
+		t.Fatalf("every image should be pulled, got %v", results)
+	}
+	var batchErr *BatchError
+	if !errors.As(err,&batchErr) || len(batchErr.Results) != 5 || !strings.Contains(err.Error(),"pull failed for 5 of 10 images") {
+		t.Errorf("unexpected error %v",err)
+	}
+	for _,result:=range results{
+		if result.Attempts != 1 || (result.Status == STATUS_FAILED) != failing[result.Image] {
+			t.Errorf("unexpected result %+v",result)
+		}
+	}
+}
+
+func TestParallelDocker_FailFast(t *testing.T) {
+	m:=map[string]string{"app0:v1":"","app1:v1":"","app2:v1":"","app3:v1":""}
+	puller:=&fakePuller{failing:map[string]bool{"app0:v1":true},failAfter:100*time.Millisecond,delay:time.Hour}
+	pd:=NewDefaultParallelDocker(m,false)
+	pd.Parallelism=2
+	pd.Puller=puller
+	pd.FailFast=true
+
+	results,err:=pd.PullImages(context.Background(),true)
+	if err == nil {
+		t.Fatal("the failure should be reported")
+	}
+	// app0 fails, app1 is canceled, the others are never started
+	if results[0].Status != STATUS_FAILED || results[1].Status != STATUS_FAILED || !errors.Is(results[1].Err,context.Canceled) {
+		t.Errorf("unexpected results %+v",results[:2])
+	}
+	if results.Count(STATUS_SKIPPED) != 2 || len(puller.pulled) != 2 {
+		t.Errorf("the images not started should be skipped, got %v",results)
+	}
+}
+
+func TestParallelDocker_Retry(t *testing.T) {
+	m:=map[string]string{"app0:v1":"","app1:v1":"","app2:v1":""}
+	puller:=&fakePuller{failing:map[string]bool{"app1:v1":true},flaky:map[string]int{"app0:v1":2,"app2:v1":5}}
+	pd:=NewDefaultParallelDocker(m,false)
+	pd.Puller=puller
+	pd.Retry=RetryPolicy{Retries:3,Delay:time.Millisecond,MaxDelay:5*time.Millisecond}
+
+	results,err:=pd.PullImages(context.Background(),true)
+	if err == nil {
+		t.Fatal("the failures should be reported")
+	}
+	// app0 succeeds on its third attempt, app1 fails permanently, app2 gives up after 4 attempts
+	if results[0].Status != STATUS_SUCCEEDED || results[0].Attempts != 3 {
+		t.Errorf("the flaky image should succeed once retried, got %+v",results[0])
+	}
+	if results[1].Status != STATUS_FAILED || results[1].Attempts != 1 {
+		t.Errorf("a permanent error should not be retried, got %+v",results[1])
+	}
+	if results[2].Status != STATUS_FAILED || results[2].Attempts != 4 || !strings.Contains(results[2].Err.Error(),"502") {
+		t.Errorf("the retries should give up, got %+v",results[2])
+	}
+}
@@ -5,29 +5,55 @@ import (
 	"fmt"
 	"log"
 	"strings"
-	"time"
 )
 
 type Puller interface {
 	Pull(ctx context.Context,image string) error
 
-	CheckIfPresent(image string) (bool,error)
+	CheckIfPresent(ctx context.Context,image string) (bool,error)
 }
 
 type Pusher interface {
 	Push(ctx context.Context,image string) error
 }
 
+// Tagger manage the tags of the local image store
+type Tagger interface {
+	// Tag create target as a new tag of the image source
+	Tag(ctx context.Context,source string,target string) error
 
-type docker struct {}
+	// Untag remove the tag, the image itself is kept if it has other tags
+	Untag(ctx context.Context,image string) error
+}
+
+
+// cliRuntime implements Puller, Pusher and Tagger by the CLI of a container runtime
+type cliRuntime struct {
+	// name of the runtime, one of RUNTIME_DOCKER, RUNTIME_PODMAN, RUNTIME_NERDCTL and RUNTIME_CTR
+	name string
+
+	// namespace of containerd, used by nerdctl and ctr only
+	namespace string
 
-func (d docker) CheckIfPresent(image string) (bool,error) {
-	path,err:=FindBestBinary("")
+	// platform pulled out of manifest lists, the one of the host if empty
+	platform string
+
+	// authDir is the directory of the config.json the registry credentials are read from, the runtime's own if empty
+	authDir string
+}
+
+func (d cliRuntime) CheckIfPresent(ctx context.Context,image string) (bool,error) {
+	var cmd []string
+	var err error
+	if d.name == RUNTIME_CTR {
+		cmd,err=d.Command("images","ls","-q","name=="+qualifyImage(image))
+	}else{
+		cmd,err=d.Command("image","list","-q",image)
+	}
 	if err != nil {
 		return false,err
 	}
-	cmd:=[]string{path,"image","list","-q",image}
-	output,err:= BashCommandExec(cmd...)
+	output,err:=runCommand(ctx,cmd...)
 	if err != nil {
 		return false,err
 	}
@@ -38,66 +64,83 @@ func (d docker) CheckIfPresent(image string) (bool,error) {
 	return true,nil
 }
 
-func (d docker) Push(ctx context.Context,image string) error{
-	path,err:=FindBestBinary("")
+func (d cliRuntime) Push(ctx context.Context,image string) error{
+	cmd,err:=d.Command(d.registryArgs("push",image)...)
 	if err != nil {
 		return err
 	}
-	pushfinished:=make(chan struct{},1)
-	errfinished:=make(chan error,1)
 	log.Printf("push image %s ... \n",image)
-	cmd:=[]string{path,"push",image}
-
-	go ExecAndSignal(cmd,pushfinished,errfinished)
-
-	for{
-		select {
-		case <-pushfinished:
-			return <-errfinished
-		case <-ctx.Done():
-			return fmt.Errorf("push image %s exceed deadline",image)
-		default:
-			time.Sleep(1*time.Second)
-		}
+	// the push is killed once ctx is done
+	output,err:=runCommand(ctx,cmd...)
+	if err != nil {
+		return err
 	}
-
-
+	log.Printf("%s done \n",strings.Join(cmd," "))
+	log.Println(output)
+	return nil
 }
 
 
 
-func (d docker) Pull(ctx context.Context,image string) error {
-	path,err:=FindBestBinary("")
+func (d cliRuntime) Pull(ctx context.Context,image string) error {
+	cmd,err:=d.Command(d.registryArgs("pull",image)...)
 	if err != nil {
 		return err
 	}
-	pullfinished:=make(chan struct{},1)
-	errfinished:=make(chan error,1)
 	log.Printf("pulling image %s ... \n",image)
-	cmd:=[]string{path,"pull",image}
-
-	go ExecAndSignal(cmd,pullfinished,errfinished)
-
-	for{
-		select {
-		case <-pullfinished:
-			return <-errfinished
-		case <-ctx.Done():
-			return fmt.Errorf("pull image %s exceed deadline",image)
-		default:
-			time.Sleep(1*time.Second)
-		}
+	// the pull is killed once ctx is done
+	output,err:=runCommand(ctx,cmd...)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s done \n",strings.Join(cmd," "))
+	log.Println(output)
+	return nil
+}
+
+func (d cliRuntime) Tag(ctx context.Context,source string,target string) error{
+	var cmd []string
+	var err error
+	if d.name == RUNTIME_CTR {
+		cmd,err=d.Command("images","tag","--force",qualifyImage(source),qualifyImage(target))
+	}else{
+		cmd,err=d.Command("tag",source,target)
+	}
+	if err != nil {
+		return err
 	}
+	_,err=runCommand(ctx,cmd...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s \n",strings.Join(cmd," "))
+	return nil
+}
 
+func (d cliRuntime) Untag(ctx context.Context,image string) error{
+	var cmd []string
+	var err error
+	if d.name == RUNTIME_CTR {
+		cmd,err=d.Command("images","rm",qualifyImage(image))
+	}else{
+		cmd,err=d.Command("rmi",image)
+	}
+	if err != nil {
+		return err
+	}
+	_,err=runCommand(ctx,cmd...)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 
 
 
 func NewDefaultPuller() Puller{
-	return docker{}
+	return NewDefaultRuntime()
 }
 func NewDefaultPusher() Pusher{
-	return docker{}
+	return NewDefaultRuntime()
 }
-
@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// this section parses image references following the grammar of docker's distribution reference:
+//
+//	reference       := name [ ":" tag ] [ "@" digest ]
+//	name            := [domain '/'] path-component ['/' path-component]*
+//	domain          := domain-component ['.' domain-component]* [':' port-number]
+//	domain-component := /([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])/
+//	path-component  := alpha-numeric [separator alpha-numeric]*
+//	tag             := /[\w][\w.-]{0,127}/
+//	digest          := algorithm ":" hex
+//
+// and normalizes names the way docker does: docker.io, library/ and latest by default
+
+var (
+	// DEFAULT_TAG is the tag of a reference without tag nor digest
+	DEFAULT_TAG = "latest"
+
+	// DOCKER_HUB_LEGACY_HOST is normalized to DOCKER_HUB_HOST
+	DOCKER_HUB_LEGACY_HOST = "index.docker.io"
+
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+)
+
+// Reference is a normalized image reference
+type Reference struct {
+	// Domain is the registry host, such as docker.io or registry:5000
+	Domain string
+
+	// Path is the repository on Domain, such as library/nginx
+	Path string
+
+	// Tag of the image, empty if the reference is pinned to a digest only
+	Tag string
+
+	// Digest the reference is pinned to, empty if none
+	Digest string
+}
+
+// ParseReference parse and normalize an image reference, such as busybox, registry:5000/app:1.0
+// or busybox@sha256:<hex>. a reference without tag nor digest is tagged as latest
+func ParseReference(image string) (Reference, error) {
+	s := strings.TrimSpace(image)
+	if s == "" {
+		return Reference{}, fmt.Errorf("image reference can't be empty")
+	}
+	ref := Reference{}
+	if i := strings.Index(s, "@"); i >= 0 {
+		s, ref.Digest = s[:i], s[i+1:]
+		if _, _, err := splitDigest(ref.Digest); err != nil {
+			return Reference{}, fmt.Errorf("image %s: %s", image, err.Error())
+		}
+	}
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		s, ref.Tag = s[:i], s[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("image %s: malformed tag %q", image, ref.Tag)
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DEFAULT_TAG
+	}
+
+	ref.Domain, ref.Path = splitDomain(s)
+	if ref.Domain != DOCKER_HUB_HOST && !domainRegexp.MatchString(ref.Domain) {
+		return Reference{}, fmt.Errorf("image %s: malformed registry host %q", image, ref.Domain)
+	}
+	for _, component := range strings.Split(ref.Path, "/") {
+		if strings.ToLower(component) == component && pathComponentRegexp.MatchString(component) {
+			continue
+		}
+		if strings.ToLower(component) != component {
+			return Reference{}, fmt.Errorf("image %s: repository name must be lowercase", image)
+		}
+		return Reference{}, fmt.Errorf("image %s: malformed repository name %q", image, ref.Path)
+	}
+	if len(ref.Name()) > MAX_LOCAL_NAME_LENGTH {
+		return Reference{}, fmt.Errorf("image %s: repository name is longer than %d characters", image, MAX_LOCAL_NAME_LENGTH)
+	}
+	return ref, nil
+}
+
+// splitDomain split a name into its registry host and repository. the first component is a
+// host if it has a dot or a port, is localhost, or has upper case letters, which a repository can't
+func splitDomain(name string) (string, string) {
+	domain, path := DOCKER_HUB_HOST, name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+			domain, path = first, name[i+1:]
+		}
+	}
+	if domain == DOCKER_HUB_LEGACY_HOST {
+		domain = DOCKER_HUB_HOST
+	}
+	if domain == DOCKER_HUB_HOST && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return domain, path
+}
+
+// Name return the fully qualified name, such as docker.io/library/nginx
+func (r Reference) Name() string {
+	return r.Domain + "/" + r.Path
+}
+
+// Ref return what the manifest is fetched by, the digest if pinned, otherwise the tag
+func (r Reference) Ref() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String return the fully qualified reference, such as docker.io/library/nginx:1.25
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// DigestTag return the tag standing for the digest, sha256:<hex> => sha256-<hex>, as a digest can't be a tag
+func DigestTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// RetagTarget return the reference load tags image as. docker can't tag an image with a digest,
+// so a reference pinned to a digest is tagged by its tag, or DigestTag if it has none:
+// busybox:1.36@sha256:<hex> => docker.io/library/busybox:1.36, busybox@sha256:<hex> => docker.io/library/busybox:sha256-<hex>.
+// other references are kept as written
+func RetagTarget(image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest == "" {
+		return image, nil
+	}
+	if ref.Tag != "" {
+		return ref.Name() + ":" + ref.Tag, nil
+	}
+	return ref.Name() + ":" + DigestTag(ref.Digest), nil
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := map[string]Reference{
+		"busybox":                             {Domain: "docker.io", Path: "library/busybox", Tag: "latest"},
+		"library/nginx":                       {Domain: "docker.io", Path: "library/nginx", Tag: "latest"},
+		"index.docker.io/nginx:1.25":          {Domain: "docker.io", Path: "library/nginx", Tag: "1.25"},
+		"registry:5000/app:1.0":               {Domain: "registry:5000", Path: "app", Tag: "1.0"},
+		"localhost/app":                       {Domain: "localhost", Path: "app", Tag: "latest"},
+		"Registry/app":                        {Domain: "Registry", Path: "app", Tag: "latest"},
+		"registry.geoway.com/cicd/jenkins:v1": {Domain: "registry.geoway.com", Path: "cicd/jenkins", Tag: "v1"},
+		"busybox@" + digest:                   {Domain: "docker.io", Path: "library/busybox", Digest: digest},
+		"busybox:1.36@" + digest:              {Domain: "docker.io", Path: "library/busybox", Tag: "1.36", Digest: digest},
+		"registry:5000/a/b/c@" + digest:       {Domain: "registry:5000", Path: "a/b/c", Digest: digest},
+	}
+	for image, want := range cases {
+		got, err := ParseReference(image)
+		if err != nil {
+			t.Errorf("%s: %s", image, err.Error())
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", image, got, want)
+		}
+	}
+	for _, image := range []string{"", "Busybox", "busybox@sha256:abc", "busybox:-1", "a.com/ns//app", "-host.com/app", "busybox:" + strings.Repeat("1", 129)} {
+		if _, err := ParseReference(image); err == nil {
+			t.Errorf("%q should be malformed", image)
+		}
+	}
+}
+
+func TestRetagTarget(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	cases := map[string]string{
+		"busybox":                "busybox",
+		"busybox@" + digest:      "docker.io/library/busybox:sha256-" + strings.Repeat("a", 64),
+		"busybox:1.36@" + digest: "docker.io/library/busybox:1.36",
+	}
+	for image, want := range cases {
+		got, err := RetagTarget(image)
+		if err != nil || got != want {
+			t.Errorf("%s: got %s %v, want %s", image, got, err, want)
+		}
+	}
+	local, err := LocalTag("busybox@" + digest)
+	if err != nil || local != "localhost:5000/docker.io/library/busybox:sha256-"+strings.Repeat("a", 64) {
+		t.Errorf("unexpected local tag %s %v", local, err)
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
 	paths "path"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -19,8 +19,23 @@ var (
 	PULL_POLICY_IFNOTPRESENT="IfNotPresent"
 	PULL_POLICY_ALWAYS="always"
 
-	// offline image tar name of registry:2
+	// archive formats of dump
+	FORMAT_REGISTRY="registry"
+	FORMAT_OCI="oci"
+
+	// offline image tar name of registry:2, which is shipped by archives of older versions
 	OFFLINE_IMAGE_NAME_OF_REGISTRY_V2="registry-v2.tar"
+
+	// ARCHIVE_ROOT is the dir of the staging dir the entries of a registry archive are under,
+	// load strips its 2 levels
+	ARCHIVE_ROOT="tmp/dump"
+
+	// CONTAINER_NAME_PREFIX is the prefix of the unique name of the registry instance, followed by the pid
+	// and the suffix of the staging dir
+	CONTAINER_NAME_PREFIX="image-batch-registry-"
+
+	// HEALTH_CHECK_TIMEOUT bounds each check of the registry instance being up, see IsHealth
+	HEALTH_CHECK_TIMEOUT=5*time.Second
 )
 
 
@@ -31,23 +46,74 @@ type Options struct {
 	Image string
 
 	// DataPath is data dir in host path, which map to `/var/lib/registry` in the container
-	// which is the data dir of docker image registry
+	// which is the data dir of docker image registry. default to the data dir of the staging dir, see WorkDir
 	DataPath string
 
+	// WorkDir is the dir each dump and load creates its own staging dir in, default to the temp dir.
+	// the data kept by load is in KEPT_DATA_DIR_NAME of it
+	WorkDir string
+
 	// Container Path is the data dir of registry in container
 	ContainerPath string
 
-	// HostPort is port of host
+	// HostPort is port of host, a free one is chosen by the runtime if 0.
+	// the port chosen is bound to the loopback interface only
 	HostPort int
 
 	// ContainerPort is port of registry container
 	ContainerPort int
 
-	// Container Name
+	// Container Name, a unique one is generated if empty, see CONTAINER_NAME_PREFIX
 	ContainerName string
 
 	// PullPolicy is pull policy of the "registry:2" image
 	PullPolicy string
+
+	// Format of the dumped archive, "registry" or "oci"
+	Format string
+
+	// BaseArchive is the previous archive a dump is made incrementally against,
+	// or the archive extracted before a delta archive is loaded
+	BaseArchive string
+
+	// KeepData keep the extracted registry data after load, so later delta archives can be loaded on top of it
+	KeepData bool
+
+	// Target is the registry load copies the images into, such as registry.internal:5000[/prefix].
+	// images are loaded into the docker daemon if it's empty
+	Target string
+
+	// TargetClient talks to Target, with its tls and auth settings
+	TargetClient *Client
+
+	// Runtime pulls, tags and pushes images, default to docker
+	Runtime Runtime
+
+	// Platforms are kept out of manifest lists by dump. load pulls the first one instead of the host platform
+	Platforms []Platform
+
+	// AllPlatforms keep every platform of manifest lists on dump
+	AllPlatforms bool
+
+	// ResolvedPlatform is the platform dump resolves manifest lists to when no platforms are kept,
+	// default to the host platform
+	ResolvedPlatform *Platform
+
+	// Pins are the manifest digests of a lockfile, image => digest. dump fetches pinned images by digest
+	Pins map[string]string
+
+	// Settings are the per-image settings of a structured image list, image => settings
+	Settings map[string]ImageSettings
+
+	// Credentials of the remote registries dump fetches the images from, anonymous if nil
+	Credentials CredentialFunc
+
+	// FailFast stop pulling, pushing or retagging the images once one failed, see ParallelDocker
+	FailFast bool
+
+	// Retry is how the fetches, copies, and the pulls, pushes and retags of the container runtime
+	// failing transiently are retried
+	Retry RetryPolicy
 }
 
 
@@ -63,58 +129,74 @@ type Registry interface {
 	// Push a image to registry, return error if something bad happens
 	Push(image string,localTag string) error
 
-	// Dump all data to a tar.gz under specified path, return error if something bad happens
-	Dump(path string) error
+	// Dump all data to a tar.gz under specified path, return error if something bad happens.
+	// the registry instance and the files left behind are cleaned up even if ctx is canceled
+	Dump(ctx context.Context,path string) error
 
 	// List all images managed by this registry
 	List() []string
 
 	// Start a registry instance
-	Start() error
+	Start(ctx context.Context) error
 
 	// Stop a registry instance
 	Stop() error
 
-	// Load extract the tar.gz to load images
-	Load(path string) error
+	// Load extract the tar.gz to load images, the extracted files are cleaned up even if ctx is canceled
+	Load(ctx context.Context,path string) error
 
 	// IsHealth check the registry is healthy
 	IsHealth() bool
+
+	// Endpoint return the host:port the registry instance is published on, empty unless started
+	Endpoint() string
 }
 // registry implements Registry
 type registry struct {
 	// current container id of registry instance
 	containerId string
 
+	// endpoint is the host:port the registry instance is published on
+	endpoint string
+
 	options *Options
 
-	puller Puller
+	// runtime pulls, tags and pushes images, and runs the registry instance
+	runtime Runtime
+
+	// fetcher writes images straight into the data dir, no registry instance is started if set
+	fetcher *NativeFetcher
 
 	// managed images list
 	images map[string]string
+
+	// staging is the staging dir of the running dump or load, see stage
+	staging string
+
+	// stagedData is true if DataPath is the data dir of staging
+	stagedData bool
 }
 
 
 
 
-func (r *registry) Start() error {
-	binary,err:=FindBestBinary(DEFAULT_CRI_BINARY)
-	if err != nil {
-		return err
+func (r *registry) Start(ctx context.Context) error {
+	if !r.runtime.CanRun() {
+		return fmt.Errorf("runtime %s can't run the registry container, dump with the native registry client instead",r.runtime.Name())
 	}
 
 	// check the image is present in local
 	image:=r.options.Image
-	exist,err:=r.puller.CheckIfPresent(image)
+	exist,err:=r.runtime.CheckIfPresent(ctx,image)
 	if err != nil {
 		return err
 	}
-	ctx,cancel:=context.WithDeadline(context.Background(),time.Now().Add(1*time.Hour))
+	pullCtx,cancel:=context.WithDeadline(ctx,time.Now().Add(1*time.Hour))
 	defer cancel()
 	if exist {
 		// pull the image if pull policy is "always"
 		if r.options.PullPolicy == PULL_POLICY_ALWAYS {
-			err:=r.puller.Pull(ctx,image)
+			err:=r.runtime.Pull(pullCtx,image)
 			if err != nil {
 				return err
 			}
@@ -122,52 +204,96 @@ func (r *registry) Start() error {
 		log.Println("skip image-pulling due to image policy,image:",image)
 	}else{
 		// pull the image if not exist
-		err:=r.puller.Pull(ctx,image)
+		err:=r.runtime.Pull(pullCtx,image)
 		if err != nil {
 			return err
 		}
 	}
 
 
-	// docker run -d -p 5000:5000 --name registry -v $(pwd)/data:/var/lib/registry registry:2
+	// docker run -d -p 127.0.0.1::5000 --name image-batch-registry-<pid>-<suffix> -v <staging>/data:/var/lib/registry registry:2
 	volPair:=fmt.Sprintf("%s:%s",r.options.DataPath,r.options.ContainerPath)
-	portPair:=fmt.Sprintf("%d:%d",r.options.HostPort,r.options.ContainerPort)
-
-	cmd:=[]string{binary, "run", "-d", "-v", volPair,"-p",portPair,"--name", r.options.ContainerName, r.options.Image}
+	portPair:=fmt.Sprintf("127.0.0.1::%d",r.options.ContainerPort)
+	if r.options.HostPort != 0 {
+		portPair=fmt.Sprintf("%d:%d",r.options.HostPort,r.options.ContainerPort)
+	}
+	name:=r.options.ContainerName
+	if name == "" {
+		// concurrent runs never share a name, the staging dir tells apart the runs of a process
+		name=fmt.Sprintf("%s%d",CONTAINER_NAME_PREFIX,os.Getpid())
+		if r.staging != "" {
+			name+="-"+strings.TrimPrefix(paths.Base(r.staging),STAGING_DIR_PREFIX)
+		}
+	}
 
-	runCommand:=exec.Command("/bin/bash","-c",strings.Join(cmd," "))
-	output,err:=runCommand.CombinedOutput()
+	// a container of the same name is refused, the leftovers of image-batch are removed by Preflight already
+	existing,err:=r.runtime.InspectContainer(ctx,name)
 	if err != nil {
-		return fmt.Errorf("exit msg: %s, "+ string(output), err.Error())
+		return err
+	}
+	if existing != nil && existing.Labels[OWNER_LABEL] == OWNER_LABEL_VALUE {
+		return fmt.Errorf("container %s is in use by image-batch pid %s",name,existing.Labels[PID_LABEL])
+	}
+	if existing != nil {
+		return fmt.Errorf("container %s exists and is not owned by image-batch, remove or rename it",name)
 	}
-	r.containerId = strings.TrimSpace(string(output))
-	log.Printf("start a new container registry, container id: %s \n", r.containerId)
-	return nil
-}
-
-func (r *registry) Stop() error {
-	binary,err:=FindBestBinary(DEFAULT_CRI_BINARY)
 
+	// the labels tell the container is a leftover once the process is gone, see FindLeftovers
+	cmd,err:=r.runtime.Command("run", "-d", "-v", volPair,"-p",portPair,"--name", name,
+		"--label",OWNER_LABEL+"="+OWNER_LABEL_VALUE,"--label",fmt.Sprintf("%s=%d",PID_LABEL,os.Getpid()),
+		"--label",HOST_LABEL+"="+HOST_ID, r.options.Image)
 	if err != nil {
 		return err
 	}
-	cmd:=[]string{binary,"rm","-f",r.containerId}
-	cmdRun:=exec.Command("/bin/bash","-c",strings.Join(cmd," "))
-	output,err:=cmdRun.CombinedOutput()
+
+	// the container may be created although run is killed, it's removed by its name then
+	r.containerId=name
+	output,err:=runCommand(ctx,cmd...)
 	if err != nil {
-		return fmt.Errorf("exit msg: %s, "+ string(output), err.Error())
+		if ctx.Err() == nil {
+			r.containerId=""
+		}
+		return err
 	}
-	log.Printf("container %s  successfully deleted \n",r.containerId)
-	r.containerId = ""
-	// clean up data volume
-	cmd=[]string{"rm","-rf",r.options.DataPath}
-	output2,err:=BashCommandExec(cmd...)
+	r.containerId = strings.TrimSpace(output)
+	log.Printf("start a new container registry %s, container id: %s \n",name,r.containerId)
+
+	// the port chosen by the runtime is only known once the container runs
+	if r.options.HostPort != 0 {
+		r.endpoint=fmt.Sprintf("localhost:%d",r.options.HostPort)
+		return nil
+	}
+	port,err:=r.runtime.PublishedPort(ctx,r.containerId,r.options.ContainerPort)
 	if err != nil {
-		return ErrorWithStderr(output2,err)
+		return err
 	}
+	r.endpoint=fmt.Sprintf("127.0.0.1:%d",port)
+	log.Printf("registry %s published on %s \n",name,r.endpoint)
 	return nil
 }
 
+// Stop remove the registry instance, if any, and the data volume. it's not canceled along with the context
+// of Start, which it cleans up after, it's bound by CLEANUP_TIMEOUT instead
+func (r *registry) Stop() error {
+	if r.containerId != "" {
+		cmd,err:=r.runtime.Command("rm","-f",r.containerId)
+		if err != nil {
+			return err
+		}
+		ctx,cancel:=cleanupContext()
+		defer cancel()
+		_,err=runCommand(ctx,cmd...)
+		if err != nil {
+			return err
+		}
+		log.Printf("container %s  successfully deleted \n",r.containerId)
+		r.containerId = ""
+		r.endpoint = ""
+	}
+	// clean up data volume
+	return os.RemoveAll(r.options.DataPath)
+}
+
 func (r *registry) GetOpts() Options {
 	rp:=r.options
 	return *rp
@@ -176,149 +302,511 @@ func (r *registry) GetOpts() Options {
 func (r *registry) Push(image string,localTag string) error {
 	// docker push localhost:5000/test
 	fmt.Printf("pushing the image %s to registry\n",image)
-	cmd,err:=DockerCmd("push",localTag)
+	err:=r.runtime.Push(context.Background(),localTag)
 	if err != nil {
 		return err
 	}
-	output, err := BashCommandExec(cmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
 	log.Printf("push image %s to registry successfuly \n",image)
 	r.images[image]=localTag
 	return nil
 }
 // Dump conforms to the following structure:
 // - data.tar.gz: that's data volume of registry
-// - images.json:  image pair list in text format(out of order)
-// - registry.tar: offline docker images of registry:2
-func (r *registry) Dump(path string) error {
-
-	synthetic:=paths.Join("tmp",fmt.Sprintf("dump-%d",rand.Intn(1000)))
-
-	// start a registry instance
-	err:=r.Start()
+// - images.json:  the images of the archive, original reference => local tag, see ImageIndex
+// - delta.json: blobs left out as the base archive carries them, only present if dumped against a base
+// - images.lock: manifest digest of every image, only present if dumped by the native client.
+//   it's written next to path as well, as path.lock
+func (r *registry) Dump(ctx context.Context,path string) error {
+	// remove what crashed runs left behind, then stage this run.
+	// the containers are only looked for if a registry container is run, the native client needs no daemon
+	var rt Runtime
+	if r.fetcher == nil {
+		rt=r.runtime
+	}
+	err:=Preflight(ctx,rt,r.options.WorkDir)
 	if err != nil {
 		return err
 	}
-	// wait the instance to be healthy
-	err=r.waitUtilHealthy()
+	err=r.stage("dump")
 	if err != nil {
 		return err
 	}
+	defer r.unstage()
+	// the archive keeps the layout of older versions, its entries are under 2 levels of dirs
+	synthetic:=paths.Join(r.staging,ARCHIVE_ROOT)
+
+	// blobs of the base archive are left out
+	var base map[string]bool
+	if r.options.BaseArchive != "" {
+		var err error
+		log.Printf("reading the blobs of base archive %s \n",r.options.BaseArchive)
+		base,err=ReadArchiveBlobs(r.options.BaseArchive)
+		if err != nil {
+			return err
+		}
+		if r.fetcher != nil {
+			r.fetcher.Base=base
+		}
+	}
 
-	pd:=NewDefaultParallelDocker(r.images,true)
-	err=pd.PushImages()
-	if err != nil {
-		return err
+	if r.fetcher != nil && r.options.Format == FORMAT_OCI {
+		return r.dumpOCI(ctx,synthetic,path)
+	}
+	if r.options.Format == FORMAT_OCI {
+		return fmt.Errorf("format %s requires the native registry client",FORMAT_OCI)
 	}
 
-	// clean it whether success or failed
+	if r.fetcher != nil {
+		defer func(){
+			// clean up data volume
+			os.RemoveAll(r.options.DataPath)
+		}()
+		// fetch the images into the data volume without a registry instance
+		err:=r.fetcher.FetchAll(ctx,r.images)
+		if err != nil {
+			return err
+		}
+		err=r.writeLock(synthetic,path)
+		if err != nil {
+			return err
+		}
+		return r.archive(ctx,synthetic,path,r.delta(r.fetcher.Required()))
+	}
+
+	log.Printf("the manifest digests are resolved by the native client only, no lockfile is written \n")
+	// clean it whether success or failed, Start may leave a container behind when it fails
 	defer func(){
 		// stop the instance
 		err1 :=r.Stop()
 		if err1 != nil {
-			fmt.Println(err.Error())
+			fmt.Println(err1.Error())
 		}
+	}()
+	// start a registry instance
+	err=r.Start(ctx)
+	if err != nil {
+		return err
+	}
+	// wait the instance to be healthy
+	err=r.waitUtilHealthy(ctx)
+	if err != nil {
+		return err
+	}
 
-		// remove the tmp
-		err2 := os.RemoveAll("tmp")
-		if err2 != nil {
-			fmt.Println(err.Error())
+	// the local tags are rebased onto the endpoint of the instance, images.json records them as pushed
+	pushed:=make(map[string]string)
+	for image,local:=range r.images{
+		pushed[image]=RebaseImage(local,r.endpoint)
+	}
+	r.images=pushed
+	// the tags of the instance are meaningless once it's stopped, they're removed whether the load is canceled or not
+	defer func(){
+		ctx,cancel:=cleanupContext()
+		defer cancel()
+		for _,v:=range pushed{
+			err:=r.runtime.Untag(ctx,v)
+			if err != nil {
+				log.Printf("remove tag %s failed: %s \n",v,err.Error())
+			}
 		}
 	}()
 
+	pd:=NewParallelDockerWithRuntime(pushed,true,r.runtime)
+	pd.FailFast=r.options.FailFast
+	pd.Retry=r.options.Retry
+	results,err:=pd.RetagImages(ctx,true)
+	log.Printf("retag %s \n",results)
+	if err != nil {
+		return err
+	}
+	results,err=pd.PushImages(ctx)
+	log.Printf("push %s \n",results)
+	if err != nil {
+		return err
+	}
 
-	// copy data volumes
-	err=copyDataVolumes(synthetic,r.options.DataPath)
+	// the pushed blobs which the base carries are left out
+	var pruned map[string]bool
+	if base != nil {
+		pruned,err=pruneBaseBlobs(r.options.DataPath,base)
+		if err != nil {
+			return err
+		}
+	}
+	return r.archive(ctx,synthetic,path,r.delta(pruned))
+}
+
+// delta return the delta against the base archive, nil if not dumped against a base
+func (r *registry) delta(required map[string]bool) *Delta{
+	if r.options.BaseArchive == "" {
+		return nil
+	}
+	delta:=NewDelta(r.options.BaseArchive,required)
+	log.Printf("%d blobs are left out as base archive %s carries them \n",len(delta.Blobs),delta.Base)
+	return delta
+}
+
+// dumpOCI fetch the images into an OCI image layout under synthetic, then compress it to path.
+// the layout is at the root of the archive, so it can be read by skopeo, crane or containerd
+func (r *registry) dumpOCI(ctx context.Context,synthetic string, path string) error {
+	layout:=NewOCILayout(synthetic)
+	r.fetcher.Storage=layout
+	err:=r.fetcher.FetchAll(ctx,r.images)
+	if err != nil {
+		return err
+	}
+	err=layout.WriteIndex()
+	if err != nil {
+		return err
+	}
+	err=r.writeLock(synthetic,path)
+	if err != nil {
+		return err
+	}
+	// oci-layout goes first, which tells the format of an archive by its first entry
+	entries:=[]string{"oci-layout","index.json","blobs",LOCK_FILE_NAME}
+	if delta:=r.delta(r.fetcher.Required());delta != nil {
+		err=PersistentDeltaToFile(delta,paths.Join(synthetic,DELTA_FILE_NAME))
+		if err != nil {
+			return err
+		}
+		entries=append(entries,DELTA_FILE_NAME)
+	}
+	err=TarCompressDirTo(ctx,path,synthetic,entries...)
+	if err != nil {
+		// a partial archive must not be taken for a complete one
+		os.Remove(path)
+	}
+	return err
+}
 
+// writeLock write the lockfile of the fetched images under synthetic and next to the archive path
+func (r *registry) writeLock(synthetic string, path string) error {
+	lock:=NewLockfile(r.fetcher.Resolved())
+	lock.SetPlatforms(r.fetcher.Platforms,r.fetcher.AllPlatforms,r.fetcher.Platform)
+	lock.SetSettings(r.options.Settings)
+	err:=os.MkdirAll(synthetic,0755)
 	if err != nil {
 		return err
 	}
-	// docker save registry:2 > registry.tar
-	err=SaveRegistryV2DockerImage(synthetic)
+	err=PersistentLockToFile(lock,paths.Join(synthetic,LOCK_FILE_NAME))
 	if err != nil {
 		return err
 	}
+	log.Printf("writing lockfile of %d images to %s.lock \n",len(lock.Images),path)
+	return PersistentLockToFile(lock,path+".lock")
+}
+
+// archive copy the data volume, image list and delta if any under synthetic, then compress it to path
+func (r *registry) archive(ctx context.Context,synthetic string, path string, delta *Delta) error {
+	// copy data volumes
+	err:=copyDataVolumes(ctx,synthetic,r.options.DataPath)
 
-	// image list pair: registry.xxx.com/xxx:tag => localhost:5000/xxx:tag
-	log.Printf("writing image pair list to %s/%s \n", synthetic, "images.json")
-	err=PersistentToFile(r.images,paths.Join(synthetic, "images.json"))
 	if err != nil {
 		return err
 	}
 
+	// image list pair: registry.xxx.com/xxx:tag => localhost:5000/registry.xxx.com/xxx:tag
+	log.Printf("writing image pair list to %s/%s \n", synthetic, "images.json")
+	var resolved map[string]string
+	if r.fetcher != nil {
+		resolved=r.fetcher.Resolved()
+	}
+	index:=NewImageIndex(r.images,resolved)
+	aliases:=make(map[string]string)
+	for image,settings:=range r.options.Settings{
+		aliases[image]=settings.Alias
+	}
+	index.SetAliases(aliases)
+	err=PersistentImageIndexToFile(index,paths.Join(synthetic, "images.json"))
+	if err != nil {
+		return err
+	}
+	if delta != nil {
+		err=PersistentDeltaToFile(delta,paths.Join(synthetic,DELTA_FILE_NAME))
+		if err != nil {
+			return err
+		}
+	}
 
 	// compressing the dump files in a whole piece file named "images.tar.gz"
-	err=TarCompressTo(path,synthetic)
+	err=TarCompressDirTo(ctx,path,r.staging,ARCHIVE_ROOT)
 	if err != nil {
+		// a partial archive must not be taken for a complete one
+		os.Remove(path)
 		return err
 	}
 
 
 	return nil
 }
-// Load from tar.gz.  extract it to current directory
-func (r *registry) Load(target string) error{
-	// extract to the current directory
-	err:=TarExtractFrom(target)
+// Load from tar.gz.  extract it to current directory, then serve the extracted data volume
+// with an in-process registry on an ephemeral port to pull the images from
+func (r *registry) Load(ctx context.Context,target string) error{
+	archives:=[]string{target}
+	if r.options.BaseArchive != "" {
+		// the base goes first, so the delta is extracted on top of it
+		archives=[]string{r.options.BaseArchive,target}
+	}
+	for _,archive:=range archives{
+		oci,err:=IsOCIArchive(archive)
+		if err != nil {
+			return err
+		}
+		if oci {
+			return fmt.Errorf("%s is an OCI image layout, load it with skopeo or crane instead",archive)
+		}
+	}
+	// remove what crashed runs left behind, the containers only if the images are loaded through the runtime
+	var puller Runtime
+	if r.options.Target == "" {
+		puller=r.runtime
+	}
+	err:=Preflight(ctx,puller,r.options.WorkDir)
 	if err != nil {
 		return err
 	}
-	// load the image of registry:2
-	err=LoadRegistryV2DockerImage("registry-v2.tar")
+	// the data kept by a previous load is loaded on, then removed unless it's kept again
+	kept:=paths.Join(r.options.WorkDir,KEPT_DATA_DIR_NAME)
+	if _,err:=os.Stat(kept);r.options.DataPath == "" && (r.options.KeepData || err == nil) {
+		created:=os.IsNotExist(err)
+		err=CheckNotInUse(kept)
+		if err != nil {
+			return err
+		}
+		err=WriteMarker(kept,"load",created)
+		if err != nil {
+			return err
+		}
+		r.options.DataPath=kept
+		defer func(){
+			r.options.DataPath=""
+			if r.options.KeepData {
+				RemoveMarker(kept)
+				return
+			}
+			os.RemoveAll(kept)
+		}()
+	}
+	err=r.stage("load")
 	if err != nil {
 		return err
 	}
-	// start the instance
-	err=r.Start()
+	defer r.unstage()
+	for _,archive:=range archives{
+		// a stale delta.json must not be taken as the one of target
+		os.RemoveAll(paths.Join(r.staging,DELTA_FILE_NAME))
+		err:=TarExtractFrom(ctx,archive,r.staging)
+		if err != nil {
+			return err
+		}
+	}
+	// the extracted data goes on top of the kept one
+	if !r.stagedData {
+		err=moveDir(paths.Join(r.staging,"data"),r.options.DataPath)
+		if err != nil {
+			return err
+		}
+	}
+	// a delta archive requires the blobs of its base
+	err=r.checkDelta()
 	if err != nil {
 		return err
 	}
+	// parse the images
+	index,err:=ParseImageIndexFromFile(paths.Join(r.staging,"images.json"))
+	if err != nil {
+		return err
+	}
+	ret:=index.Pairs()
+	r.images=ret
+	// the references the images are restored as, target => local tag
+	targets:=make(map[string]string)
+	for _,record:=range index.Images{
+		target,err:=record.Target()
+		if err != nil {
+			return err
+		}
+		targets[target]=record.Local
+	}
+
+	if r.options.Target != "" {
+		// push the images into the target registry, the docker daemon is not involved
+		copier,err:=NewDefaultRegistryCopier(r.options.DataPath,r.options.Target,r.options.TargetClient)
+		if err != nil {
+			return err
+		}
+		copier.FailFast=r.options.FailFast
+		copier.Retry=r.options.Retry
+		// a registry takes digests, images are pushed as their alias or original reference
+		copied:=make(map[string]string)
+		for _,record:=range index.Images{
+			if record.Alias != "" {
+				copied[record.Alias]=record.Local
+			}else{
+				copied[record.Reference]=record.Local
+			}
+		}
+		return copier.CopyAll(ctx,copied)
+	}
 
+	// the runtime pulls the platform of the host out of manifest lists unless one is given
+	platform:=HostPlatform()
+	rt:=r.runtime
+	if len(r.options.Platforms) != 0 {
+		platform=r.options.Platforms[0]
+		rt=rt.ForPlatform(platform.String())
+	}
+	err=checkPlatform(NewStorage(r.options.DataPath),ret,platform)
+	if err != nil {
+		return err
+	}
+
+	// serve the data volume
+	server:=NewServer(r.options.DataPath)
+	err=server.Start()
+	if err != nil {
+		return err
+	}
 	defer func() {
 		// stop the instance
 		fmt.Println("stop the instance")
-		err=r.Stop()
+		err:=server.Stop()
 		if err != nil {
 			fmt.Println(err.Error())
 		}
-		removeExtractedData()
 	}()
-	// waiting the registry up
-	err=r.waitUtilHealthy()
+
+	// the local tags are served by the in-process registry instead of localhost:5000.
+	// images are tagged as their ImageRecord.Target
+	served:=make(map[string]string)
+	for k,v:=range targets{
+		served[k]=RebaseImage(v,server.Addr())
+	}
+
+	// load images and retag to origin image tag
+	pd:=NewParallelDockerWithRuntime(served,true,rt)
+	pd.FailFast=r.options.FailFast
+	pd.Retry=r.options.Retry
+	results,err:=pd.PullImages(ctx,false)
+	log.Printf("pull %s \n",results)
 	if err != nil {
 		return err
 	}
-	// parse the images
-	ret,err:=ParseFromFile("images.json")
+	results,err=pd.RetagImages(ctx,false)
+	log.Printf("retag %s \n",results)
 	if err != nil {
 		return err
 	}
-	r.images=ret
+	// the tags of the in-process registry are meaningless once it's stopped
+	for _,v:=range served{
+		err:=r.runtime.Untag(ctx,v)
+		if err != nil {
+			log.Printf("remove tag %s failed: %s \n",v,err.Error())
+		}
+	}
 
-	// load images and retag to origin image tag
-	pd:=NewDefaultParallelDocker(ret,true)
-	err=pd.PullImages(false)
+	return nil
+}
+
+// checkDelta make sure the blobs required by an extracted delta archive are present in the registry data
+func (r *registry) checkDelta() error{
+	delta,err:=ParseDeltaFromFile(paths.Join(r.staging,DELTA_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	err=pd.RetagImages(false)
+	missing:=delta.Missing(NewStorage(r.options.DataPath))
+	if len(missing) != 0 {
+		return fmt.Errorf("the archive is a delta against %s, %d of its blobs are missing in %s. load %s first with --keep-data or pass it with --base",
+			delta.Base,len(missing),r.options.DataPath,delta.Base)
+	}
+	log.Printf("all %d blobs of base archive %s are present \n",len(delta.Blobs),delta.Base)
+	return nil
+}
+
+// checkPlatform make sure every manifest list of images carries the manifest of platform,
+// archives dumped with --platform may leave it out
+func checkPlatform(storage *Storage,images map[string]string,platform Platform) error{
+	for image,localTag:=range images{
+		_,repo,tag:=splitRemoteImage(localTag)
+		platforms,err:=storage.Platforms(repo,tag)
+		if err != nil {
+			return fmt.Errorf("image %s: %s",image,err.Error())
+		}
+		if platforms == nil {
+			continue
+		}
+		found:=false
+		present:=make([]string,0,len(platforms))
+		for _,p:=range platforms{
+			found=found || p.Matches(platform)
+			present=append(present,p.String())
+		}
+		if !found {
+			return fmt.Errorf("image %s: the archive has no manifest for platform %s, it carries %s",image,platform.String(),strings.Join(present,","))
+		}
+	}
+	return nil
+}
+
+// stage create the staging dir of this run in WorkDir, marked as the one of this run. DataPath is the data dir
+// of it unless it's set
+func (r *registry) stage(command string) error{
+	err:=os.MkdirAll(r.options.WorkDir,0755)
 	if err != nil {
 		return err
 	}
-
+	staging,err:=os.MkdirTemp(r.options.WorkDir,STAGING_DIR_PREFIX)
+	if err != nil {
+		return err
+	}
+	r.staging=staging
+	err=WriteMarker(staging,command,true)
+	if err != nil {
+		return err
+	}
+	if r.options.DataPath == "" {
+		r.options.DataPath=paths.Join(staging,"data")
+		r.stagedData=true
+		if r.fetcher != nil {
+			r.fetcher.Storage=NewStorage(r.options.DataPath)
+		}
+	}
+	log.Printf("staging in %s \n",staging)
 	return nil
 }
 
-// removeExtractedData remove all tmp files extracted
-func removeExtractedData(){
-	// clean up the extracted data
-	os.RemoveAll("data")
-	os.RemoveAll("images.json")
-	os.RemoveAll(OFFLINE_IMAGE_NAME_OF_REGISTRY_V2)
+// unstage remove the staging dir, with everything extracted or written into it
+func (r *registry) unstage(){
+	os.RemoveAll(r.staging)
+	r.staging=""
+	if r.stagedData {
+		r.options.DataPath=""
+		r.stagedData=false
+	}
+}
+
+// moveDir move the files of src into dst, replacing the ones of the same path
+func moveDir(src string,dst string) error{
+	return filepath.Walk(src,func(path string,info os.FileInfo,err error) error{
+		if err != nil {
+			return err
+		}
+		rel,err:=filepath.Rel(src,path)
+		if err != nil {
+			return err
+		}
+		target:=filepath.Join(dst,rel)
+		if info.IsDir() {
+			return os.MkdirAll(target,0755)
+		}
+		return os.Rename(path,target)
+	})
 }
-func copyDataVolumes(dst string, source string) error {
+func copyDataVolumes(ctx context.Context,dst string, source string) error {
 	err:=os.MkdirAll(dst,0644)
 	if err != nil {
 		return err
@@ -326,11 +814,8 @@ func copyDataVolumes(dst string, source string) error {
 	// copy the data directory
 	log.Printf("copy data directory from %s to %s \n",source,dst)
 	cmd:=[]string{"/bin/cp","-rf",source,dst}
-	output,err:=BashCommandExec(cmd...)
-	if err != nil {
-		return ErrorWithStderr(output,err)
-	}
-	return nil
+	_,err=runCommand(ctx,cmd...)
+	return err
 }
 
 
@@ -342,21 +827,40 @@ func (r *registry) List() []string {
 	return ret
 }
 
+func (r *registry) Endpoint() string{
+	return r.endpoint
+}
+
 func (r *registry) IsHealth() bool{
-	resp,err:=http.Get("http://localhost:5000/v2/_catalog")
+	return r.isHealthy(context.Background())
+}
+
+// isHealthy check the registry answers its catalog, an answer taking longer than HEALTH_CHECK_TIMEOUT or
+// ctx being done tells it's not
+func (r *registry) isHealthy(ctx context.Context) bool{
+	if r.endpoint == "" {
+		return false
+	}
+	req,err:=http.NewRequestWithContext(ctx,http.MethodGet,"http://"+r.endpoint+"/v2/_catalog",nil)
 	if err != nil {
 		return false
 	}
+	client:=&http.Client{Timeout:HEALTH_CHECK_TIMEOUT}
+	resp,err:=client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK{
 		return false
 	}
 	return true
 }
 
-func (r *registry) waitUtilHealthy() error{
-	ctx,cancel:=context.WithTimeout(context.Background(),3*time.Minute)
+func (r *registry) waitUtilHealthy(ctx context.Context) error{
+	ctx,cancel:=context.WithTimeout(ctx,3*time.Minute)
 	defer cancel()
-	for !r.IsHealth() {
+	for !r.isHealthy(ctx) {
 		select {
 		case <-ctx.Done():
 			fmt.Printf("waiting for registry up timeout,timeout duartion:%dmin \n",3)
@@ -374,17 +878,111 @@ func NewDefaultOptions() []Opt{
 	return []Opt{
 		func(options *Options){
 			options.ContainerPort= 5000
-			options.HostPort=5000
 			options.Image= "registry:2"
-			wd,_:=os.Getwd()
-			options.DataPath=paths.Join(wd,"data")
+			options.WorkDir=os.TempDir()
 			options.ContainerPath="/var/lib/registry"
-			options.ContainerName="registry"
 			options.PullPolicy=PULL_POLICY_IFNOTPRESENT
+			options.Format=FORMAT_REGISTRY
+			options.Retry=NewDefaultRetryPolicy()
 		},
 	}
 }
 
+// WithBaseArchive set the base archive of an incremental dump, or the base of a delta archive to load
+func WithBaseArchive(path string) Opt{
+	return func(options *Options){
+		options.BaseArchive=path
+	}
+}
+
+// WithKeepData keep the registry data extracted by load
+func WithKeepData(keep bool) Opt{
+	return func(options *Options){
+		options.KeepData=keep
+	}
+}
+
+// WithTarget load the images into the target registry through client instead of the docker daemon
+func WithTarget(target string,client *Client) Opt{
+	return func(options *Options){
+		options.Target=target
+		options.TargetClient=client
+	}
+}
+
+// WithRuntime use the container runtime rt instead of docker
+func WithRuntime(rt Runtime) Opt{
+	return func(options *Options){
+		options.Runtime=rt
+	}
+}
+
+// WithPlatforms set the platforms kept by dump or pulled by load, all keep every platform on dump
+func WithPlatforms(platforms []Platform,all bool) Opt{
+	return func(options *Options){
+		options.Platforms=platforms
+		options.AllPlatforms=all
+	}
+}
+
+// WithResolvedPlatform resolve manifest lists to platform instead of the host platform on dump, when no platforms are kept
+func WithResolvedPlatform(platform Platform) Opt{
+	return func(options *Options){
+		options.ResolvedPlatform=&platform
+	}
+}
+
+// WithPins fetch the images by the manifest digests of a lockfile instead of their tags
+func WithPins(pins map[string]string) Opt{
+	return func(options *Options){
+		options.Pins=pins
+	}
+}
+
+// WithImageSettings apply the per-image settings of a structured image list
+func WithImageSettings(settings map[string]ImageSettings) Opt{
+	return func(options *Options){
+		options.Settings=settings
+	}
+}
+
+// WithCredentials fetch the images of dump with the credentials of their registries
+func WithCredentials(credentials CredentialFunc) Opt{
+	return func(options *Options){
+		options.Credentials=credentials
+	}
+}
+
+// WithFailFast stop the batches of images once one failed instead of going through every image
+func WithFailFast(failFast bool) Opt{
+	return func(options *Options){
+		options.FailFast=failFast
+	}
+}
+
+// WithRetry retry the fetches, copies, and the pulls, pushes and retags of the container runtime as retry says
+func WithRetry(retry RetryPolicy) Opt{
+	return func(options *Options){
+		options.Retry=retry
+	}
+}
+
+// WithWorkDir create the staging dir of each dump and load in dir instead of the temp dir, an empty dir is ignored
+func WithWorkDir(dir string) Opt{
+	return func(options *Options){
+		if dir != "" {
+			options.WorkDir=dir
+		}
+	}
+}
+
+// WithFormat set the format of the dumped archive
+func WithFormat(format string) Opt{
+	return func(options *Options){
+		options.Format=format
+	}
+}
+
 
 func NewDefaultRegistry(opts... Opt) Registry{
 
@@ -395,7 +993,7 @@ func NewDefaultRegistry(opts... Opt) Registry{
 	}
 	return &registry{
 		options: optPtr,
-		puller: NewDefaultPuller(),
+		runtime: runtimeOf(optPtr),
 		images: make(map[string]string),
 	}
 }
@@ -414,13 +1012,39 @@ func NewDefaultRegistryWithImagesPredefined(images map[string]string, opts... Op
 	}
 	return &registry{
 		options: optPtr,
-		puller: NewDefaultPuller(),
+		runtime: runtimeOf(optPtr),
 		images: m,
 	}
 
 }
 
 
+// NewNativeRegistryWithImagesPredefined return a registry which dumps images fetched by the
+// native registry client, it doesn't need a docker daemon to dump
+func NewNativeRegistryWithImagesPredefined(images map[string]string, opts... Opt) Registry{
+	r:=NewDefaultRegistryWithImagesPredefined(images,opts...).(*registry)
+	r.fetcher=NewDefaultNativeFetcher(r.options.DataPath)
+	r.fetcher.Platforms=r.options.Platforms
+	r.fetcher.AllPlatforms=r.options.AllPlatforms
+	if r.options.ResolvedPlatform != nil {
+		r.fetcher.Platform=*r.options.ResolvedPlatform
+	}
+	r.fetcher.Pins=r.options.Pins
+	r.fetcher.Settings=r.options.Settings
+	r.fetcher.Client.Credentials=r.options.Credentials
+	r.fetcher.FailFast=r.options.FailFast
+	r.fetcher.Retry=r.options.Retry
+	return r
+}
+
+// runtimeOf return the runtime of options, default to docker
+func runtimeOf(options *Options) Runtime{
+	if options.Runtime == nil {
+		return NewDefaultRuntime()
+	}
+	return options.Runtime
+}
+
 // FindBestBinary find the available cri CLI binary under os path. default to docker
 func FindBestBinary(cri string) (string,error){
 	if strings.TrimSpace(cri) == ""{
@@ -3,6 +3,8 @@ package registry
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os/exec"
 	"strings"
 	"testing"
@@ -23,7 +25,7 @@ func TestNewDefaultRegistry(t *testing.T) {
 
 	registry:=NewDefaultRegistry(opts...)
 
-	err:=registry.Start()
+	err:=registry.Start(context.Background())
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -48,7 +50,7 @@ func TestDockerPuller_Pull(t *testing.T) {
 
 func TestDockerPuller_CheckIfPresent(t *testing.T) {
 	puller:=NewDefaultPuller()
-	ok,err:=puller.CheckIfPresent("registry:3")
+	ok,err:=puller.CheckIfPresent(context.Background(),"registry:3")
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -70,7 +72,7 @@ func TestDump(t *testing.T){
 
 	registry:=NewDefaultRegistry(opts...)
 
-	err:=registry.Dump("/root/registry/images.tar.gz")
+	err:=registry.Dump(context.Background(),"/root/registry/images.tar.gz")
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -80,7 +82,7 @@ func TestLoad(t *testing.T){
 
 	registry:=NewDefaultRegistry(opts...)
 
-	err:=registry.Load("/root/registry/images.tar.gz")
+	err:=registry.Load(context.Background(),"/root/registry/images.tar.gz")
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -121,6 +123,25 @@ func TestRegistry_IsHealth(t *testing.T) {
 	}
 }
 
+func TestRegistry_WaitUtilHealthyHanging(t *testing.T) {
+	// a registry accepting connections but never answering
+	done:=make(chan struct{})
+	server:=httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,req *http.Request){
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	r:=&registry{options:&Options{},endpoint:strings.TrimPrefix(server.URL,"http://")}
+
+	ctx,cancel:=context.WithTimeout(context.Background(),200*time.Millisecond)
+	defer cancel()
+	start:=time.Now()
+	err:=r.waitUtilHealthy(ctx)
+	if err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("waiting should stop once the context is done, got %v after %s",err,time.Since(start))
+	}
+}
+
 func TestConfirmDaemonJson(t *testing.T) {
 	modified,err := ConfirmDaemonJson()
 	if err != nil {
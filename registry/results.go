@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// this section describes the outcome of a batch of image tasks, one result per image
+
+var (
+	// statuses of an image task
+	STATUS_SUCCEEDED = "succeeded"
+	STATUS_FAILED    = "failed"
+	// STATUS_SKIPPED is the status of the images not run as an earlier one failed in fail-fast mode
+	STATUS_SKIPPED = "skipped"
+
+	// failure modes of a batch
+	MODE_KEEP_GOING = "keep-going"
+	MODE_FAIL_FAST  = "fail-fast"
+)
+
+// ImageResult is the outcome of pulling, pushing or retagging an image
+type ImageResult struct {
+	// Image is the image, or the `source target` pair of a retag
+	Image string
+
+	// Status is STATUS_SUCCEEDED, STATUS_FAILED or STATUS_SKIPPED
+	Status string
+
+	// Err is the error of the last attempt, nil unless the task failed
+	Err error
+
+	// Duration of the task, every attempt included
+	Duration time.Duration
+
+	// Attempts is the number of times the task ran, 0 if it was skipped
+	Attempts int
+}
+
+// Results are the results of a batch, sorted by image
+type Results []ImageResult
+
+// Count return the number of the results of status
+func (r Results) Count(status string) int {
+	n := 0
+	for _, result := range r {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Err return a *BatchError if an image failed or was skipped, otherwise nil
+func (r Results) Err(action string) error {
+	if r.Count(STATUS_SUCCEEDED) == len(r) {
+		return nil
+	}
+	e := &BatchError{Action: action, Total: len(r)}
+	for _, result := range r {
+		if result.Status != STATUS_SUCCEEDED {
+			e.Results = append(e.Results, result)
+		}
+	}
+	return e
+}
+
+// BatchError is returned by a batch some of whose images failed or were skipped
+type BatchError struct {
+	// Action of the batch, such as pull
+	Action string
+
+	// Total is the number of images of the batch
+	Total int
+
+	// Results of the images which failed or were skipped
+	Results Results
+}
+
+func (e *BatchError) Error() string {
+	failed := make([]string, 0)
+	for _, result := range e.Results {
+		if result.Status == STATUS_FAILED {
+			failed = append(failed, fmt.Sprintf("%s: %s", result.Image, result.Err.Error()))
+		}
+	}
+	msg := fmt.Sprintf("%s failed for %d of %d images", e.Action, e.Results.Count(STATUS_FAILED), e.Total)
+	if skipped := e.Results.Count(STATUS_SKIPPED); skipped != 0 {
+		msg += fmt.Sprintf(", %d skipped", skipped)
+	}
+	return msg + ": " + strings.Join(failed, "; ")
+}
+
+// String summarize the results, such as `5 images, 3 succeeded, 1 failed, 1 skipped`
+func (r Results) String() string {
+	s := fmt.Sprintf("%d images", len(r))
+	for _, status := range []string{STATUS_SUCCEEDED, STATUS_FAILED, STATUS_SKIPPED} {
+		if n := r.Count(status); n != 0 {
+			s += fmt.Sprintf(", %d %s", n, status)
+		}
+	}
+	return s
+}
+
+// runBatch run the action of every item by parallelism workers, each fetching one item at a time from a work queue
+// until it's drained. a failed item never stops a worker. if failFast is true, the items not started yet once an
+// item failed are skipped and the running ones are canceled. each run of the task is given timeout, unless it's 0,
+// and retried as retry says. return the result of every item, in the order of items
+func runBatch(ctx context.Context, action string, items []string, parallelism int, failFast bool, timeout time.Duration, retry RetryPolicy, task func(ctx context.Context, item string) error) Results {
+	results := make(Results, len(items))
+	workqueue := NewDefaultQueue()
+	for i := range items {
+		// not handle err, the queue only holds ints
+		_ = workqueue.Enqueue(i)
+	}
+	batch, cancelBatch := context.WithCancel(ctx)
+	defer cancelBatch()
+
+	worker := func() {
+		for {
+			indexUntyped := workqueue.Dequeue()
+			if indexUntyped == nil {
+				return
+			}
+			i := indexUntyped.(int)
+			if failFast && batch.Err() != nil {
+				results[i] = ImageResult{Image: items[i], Status: STATUS_SKIPPED}
+				continue
+			}
+			results[i] = runTask(batch, action, items[i], timeout, retry, task)
+			if results[i].Status == STATUS_FAILED {
+				log.Printf("image %s failed: %s \n", items[i], results[i].Err.Error())
+				if failFast {
+					cancelBatch()
+				}
+			}
+		}
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for n := 0; n < parallelism; n++ {
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// runTask run the task of item, each attempt with timeout unless it's 0, until it succeeds, fails permanently
+// or retry gives up
+func runTask(ctx context.Context, action string, item string, timeout time.Duration, retry RetryPolicy, task func(ctx context.Context, item string) error) ImageResult {
+	result := ImageResult{Image: item}
+	start := time.Now()
+	for {
+		result.Attempts++
+		result.Err = runAttempt(ctx, item, timeout, task)
+		if result.Err == nil || result.Attempts > retry.Retries || IsPermanentError(result.Err) || ctx.Err() != nil {
+			break
+		}
+		delay := retry.Backoff(result.Attempts)
+		log.Printf("%s %s failed on attempt %d of %d: %s, retrying in %s \n", action, item, result.Attempts, retry.Retries+1, result.Err.Error(), delay)
+		select {
+		case <-time.After(delay):
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	result.Duration = time.Since(start)
+	result.Status = STATUS_SUCCEEDED
+	if result.Err != nil {
+		result.Status = STATUS_FAILED
+	}
+	return result
+}
+
+func runAttempt(ctx context.Context, item string, timeout time.Duration, task func(ctx context.Context, item string) error) error {
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return task(ctx, item)
+}
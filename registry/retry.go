@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// this section retries the image tasks failing transiently, such as on a 502 of the registry
+// or a network blip, with an exponential backoff
+
+var (
+	// defaults of RetryPolicy
+	DEFAULT_RETRIES         = 3
+	DEFAULT_RETRY_DELAY     = 2 * time.Second
+	DEFAULT_RETRY_MAX_DELAY = time.Minute
+	DEFAULT_RETRY_JITTER    = 0.2
+
+	// PERMANENT_ERROR_MESSAGES are the messages of the errors retrying never fixes, as printed by the
+	// registries and the container runtimes. they are matched case insensitively
+	PERMANENT_ERROR_MESSAGES = []string{
+		"manifest unknown",
+		"name unknown",
+		"unauthorized",
+		"denied",
+		"authentication required",
+		"invalid reference format",
+		"no such image",
+		"not found",
+		"is not present and its pull policy is",
+	}
+)
+
+// RetryPolicy is how often and how late a failed task is run again
+type RetryPolicy struct {
+	// Retries is the number of runs after the first one, 0 never retries
+	Retries int
+
+	// Delay before the first retry, doubled for each of the next ones
+	Delay time.Duration
+
+	// MaxDelay caps the delay between two runs
+	MaxDelay time.Duration
+
+	// Jitter spreads the delay by up to this fraction of it, such as 0.2 for ±20%. a capped delay is spread
+	// below MaxDelay only, so the retries reaching the cap together are spread still
+	Jitter float64
+}
+
+// NewDefaultRetryPolicy return the policy of DEFAULT_RETRIES, DEFAULT_RETRY_DELAY, DEFAULT_RETRY_MAX_DELAY and DEFAULT_RETRY_JITTER
+func NewDefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Retries:  DEFAULT_RETRIES,
+		Delay:    DEFAULT_RETRY_DELAY,
+		MaxDelay: DEFAULT_RETRY_MAX_DELAY,
+		Jitter:   DEFAULT_RETRY_JITTER,
+	}
+}
+
+// Backoff return the delay before the retry following the attempt, attempt counts from 1.
+// with a jitter, a capped delay is within [MaxDelay*(1-Jitter), MaxDelay]
+func (r RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := r.Delay
+	for i := 1; i < attempt && (r.MaxDelay == 0 || delay < r.MaxDelay); i++ {
+		delay *= 2
+	}
+	if r.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 + r.Jitter*(2*rand.Float64()-1)))
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	return delay
+}
+
+// IsPermanentError return true if retrying can't fix err: a cancellation, a client error of the registry
+// other than a timeout or a rate limit, or one of PERMANENT_ERROR_MESSAGES
+func IsPermanentError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+	}
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range PERMANENT_ERROR_MESSAGES {
+		if strings.Contains(msg, permanent) {
+			return true
+		}
+	}
+	return false
+}
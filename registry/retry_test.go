@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{Retries: 10, Delay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if d := policy.Backoff(attempt + 1); d != expected {
+			t.Errorf("attempt %d: expected %s, got %s", attempt+1, expected, d)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := policy.Backoff(2); d < time.Second || d > 3*time.Second {
+			t.Fatalf("the jitter should keep the delay within 50%%, got %s", d)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if d := policy.Backoff(50); d < 5*time.Second || d > 10*time.Second {
+			t.Fatalf("the jittered delay should be capped and spread below the cap, got %s", d)
+		}
+	}
+}
+
+func TestIsPermanentError(t *testing.T) {
+	for err, expected := range map[error]bool{
+		errors.New("Error response from daemon: manifest for app:v9 not found: manifest unknown"): true,
+		errors.New("unauthorized: authentication required"):                                       true,
+		errors.New("denied: requested access to the resource is denied"):                          true,
+		errors.New("net/http: TLS handshake timeout"):                                             false,
+		errors.New("received unexpected HTTP status: 503 Service Unavailable"):                    false,
+		fmt.Errorf("pull: %w", context.Canceled):                                                  true,
+		fmt.Errorf("pull: %w", context.DeadlineExceeded):                                          false,
+		&StatusError{StatusCode: http.StatusNotFound}:                                             true,
+		&StatusError{StatusCode: http.StatusTooManyRequests}:                                      false,
+		&StatusError{StatusCode: http.StatusBadGateway}:                                           false,
+	} {
+		if IsPermanentError(err) != expected {
+			t.Errorf("%v: expected permanent %v", err, expected)
+		}
+	}
+}
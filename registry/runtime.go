@@ -0,0 +1,337 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// this section chooses the container runtime CLI images are pulled, tagged and pushed through
+
+var (
+	RUNTIME_AUTO    = "auto"
+	RUNTIME_DOCKER  = "docker"
+	RUNTIME_PODMAN  = "podman"
+	RUNTIME_NERDCTL = "nerdctl"
+	RUNTIME_CTR     = "ctr"
+
+	// RUNTIME_DETECT_ORDER is the order runtimes are looked up in by auto-detection
+	RUNTIME_DETECT_ORDER = []string{RUNTIME_DOCKER, RUNTIME_PODMAN, RUNTIME_NERDCTL, RUNTIME_CTR}
+)
+
+// Runtime is a container runtime the images are loaded into or dumped from
+type Runtime interface {
+	Puller
+	Pusher
+	Tagger
+
+	// Name of the runtime, such as docker
+	Name() string
+
+	// Command return the command line of the runtime binary running args,
+	// with the global flags of the runtime such as the containerd namespace
+	Command(args ...string) ([]string, error)
+
+	// CanRun return true if the runtime can run the registry:2 container with a published port
+	CanRun() bool
+
+	// ForPlatform return the runtime pulling the manifest of platform, such as linux/arm64,
+	// out of manifest lists instead of the one of the host
+	ForPlatform(platform string) Runtime
+
+	// ListImages return the references of the images of the local image store matching the filters,
+	// such as reference=myapp/* or label=release=2.3, combined as `docker image ls --filter` does
+	ListImages(ctx context.Context, filters []string) ([]string, error)
+
+	// WithAuthFile return the runtime reading the registry credentials from file, in the format of
+	// docker's config.json, instead of its own. release removes the copy of file made for the runtime, if any
+	WithAuthFile(file string) (rt Runtime, release func(), err error)
+
+	// ListContainers return the containers, running or not, carrying the label key=value
+	ListContainers(ctx context.Context, label string) ([]Container, error)
+
+	// InspectContainer return the container of the name or id, nil if there's none
+	InspectContainer(ctx context.Context, name string) (*Container, error)
+
+	// PublishedPort return the host port the tcp port of the container is published on
+	PublishedPort(ctx context.Context, container string, port int) (int, error)
+}
+
+// Container is a container of a runtime
+type Container struct {
+	// ID of the container
+	ID string
+
+	// Name of the container, such as registry
+	Name string
+
+	// Labels of the container
+	Labels map[string]string
+}
+
+func (d cliRuntime) Name() string {
+	return d.name
+}
+
+func (d cliRuntime) Command(args ...string) ([]string, error) {
+	path, err := FindBestBinary(d.name)
+	if err != nil {
+		return []string{}, err
+	}
+	cmd := []string{path}
+	if d.authDir != "" {
+		// docker and nerdctl read $DOCKER_CONFIG/config.json, podman $REGISTRY_AUTH_FILE
+		cmd = []string{"env", DOCKER_CONFIG_ENV + "=" + d.authDir, "REGISTRY_AUTH_FILE=" + filepath.Join(d.authDir, DOCKER_CONFIG_FILE_NAME), path}
+	}
+	if d.namespace != "" {
+		switch d.name {
+		case RUNTIME_NERDCTL:
+			cmd = append(cmd, "--namespace", d.namespace)
+		case RUNTIME_CTR:
+			cmd = append(cmd, "-n", d.namespace)
+		}
+	}
+	return append(cmd, args...), nil
+}
+
+func (d cliRuntime) CanRun() bool {
+	return d.name != RUNTIME_CTR
+}
+
+func (d cliRuntime) ForPlatform(platform string) Runtime {
+	d.platform = platform
+	return d
+}
+
+func (d cliRuntime) ListImages(ctx context.Context, filters []string) ([]string, error) {
+	if d.name == RUNTIME_CTR {
+		return nil, fmt.Errorf("runtime %s can't filter local images, use docker, podman or nerdctl", d.name)
+	}
+	args := []string{"image", "list", "--format", "{{.Repository}}:{{.Tag}}"}
+	for _, filter := range filters {
+		if !strings.Contains(filter, "=") {
+			return nil, fmt.Errorf("malformed filter %s, must be key=value such as reference=myapp/*", filter)
+		}
+		args = append(args, "--filter", filter)
+	}
+	cmd, err := d.Command(args...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runCommand(ctx, cmd...)
+	if err != nil {
+		return nil, err
+	}
+	return parseImageListOutput(output), nil
+}
+
+func (d cliRuntime) ListContainers(ctx context.Context, label string) ([]Container, error) {
+	if !d.CanRun() {
+		// the registry container is never run by ctr
+		return nil, nil
+	}
+	cmd, err := d.Command("ps", "-a", "-q", "--no-trunc", "--filter", "label="+label)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runCommand(ctx, cmd...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Container, 0)
+	for _, id := range strings.Fields(output) {
+		container, err := d.InspectContainer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		// removed meanwhile
+		if container != nil {
+			ret = append(ret, *container)
+		}
+	}
+	return ret, nil
+}
+
+func (d cliRuntime) InspectContainer(ctx context.Context, name string) (*Container, error) {
+	if !d.CanRun() {
+		return nil, nil
+	}
+	cmd, err := d.Command("container", "inspect", "--format", "{{.ID}}\t{{.Name}}\t{{json .Config.Labels}}", name)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runCommand(ctx, cmd...)
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "no such") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseContainerInspectOutput(output)
+}
+
+func (d cliRuntime) PublishedPort(ctx context.Context, container string, port int) (int, error) {
+	if !d.CanRun() {
+		return 0, fmt.Errorf("runtime %s can't publish the ports of containers", d.name)
+	}
+	cmd, err := d.Command("port", container, fmt.Sprintf("%d/tcp", port))
+	if err != nil {
+		return 0, err
+	}
+	output, err := runCommand(ctx, cmd...)
+	if err != nil {
+		return 0, err
+	}
+	return parsePortOutput(output)
+}
+
+// parsePortOutput parse the host port of the first `address:port` line of `port`, such as 0.0.0.0:49153
+func parsePortOutput(output string) (int, error) {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+	_, port, err := net.SplitHostPort(line)
+	if err != nil {
+		return 0, fmt.Errorf("malformed output of port: %q", output)
+	}
+	return strconv.Atoi(port)
+}
+
+// parseContainerInspectOutput parse the `id name labels` line of `container inspect`
+func parseContainerInspectOutput(output string) (*Container, error) {
+	fields := strings.SplitN(strings.TrimSpace(output), "\t", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("malformed output of container inspect: %q", output)
+	}
+	container := &Container{ID: fields[0], Name: strings.TrimPrefix(fields[1], "/")}
+	err := json.Unmarshal([]byte(fields[2]), &container.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("malformed labels of container %s: %s", container.Name, err.Error())
+	}
+	return container, nil
+}
+
+// parseImageListOutput return the repository:tag lines of `image list`, without the untagged images and duplicates
+func parseImageListOutput(output string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.Contains(line, "<none>") || seen[line] {
+			continue
+		}
+		seen[line] = true
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+// WithAuthFile point the runtime at the directory of file, which is copied into a private directory
+// unless it's named config.json. ctr only pulls from the loopback registry and never needs credentials
+func (d cliRuntime) WithAuthFile(file string) (Runtime, func(), error) {
+	if d.name == RUNTIME_CTR {
+		return d, func() {}, nil
+	}
+	if filepath.Base(file) == DOCKER_CONFIG_FILE_NAME {
+		dir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil {
+			return nil, nil, err
+		}
+		d.authDir = dir
+		return d, func() {}, nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := os.MkdirTemp("", "image-batch-auth-")
+	if err != nil {
+		return nil, nil, err
+	}
+	// the copy holds the credentials, it must not outlive the run
+	release := func() {
+		os.RemoveAll(dir)
+	}
+	err = os.WriteFile(filepath.Join(dir, DOCKER_CONFIG_FILE_NAME), content, 0600)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	d.authDir = dir
+	return d, release, nil
+}
+
+// registryArgs build the args of pull or push, registries on the loopback interface are
+// spoken to over plain http. docker trusts them by default, others have to be told.
+// pulls are pinned to the platform of the runtime if set
+func (d cliRuntime) registryArgs(action string, image string) []string {
+	host, _, _ := splitRemoteImage(image)
+	insecure := isLoopbackHost(host)
+	flags := make([]string, 0)
+	if action == "pull" && d.platform != "" {
+		flags = append(flags, "--platform", d.platform)
+	}
+	switch d.name {
+	case RUNTIME_PODMAN:
+		if insecure {
+			flags = append(flags, "--tls-verify=false")
+		}
+	case RUNTIME_NERDCTL:
+		if insecure {
+			flags = append(flags, "--insecure-registry")
+		}
+	case RUNTIME_CTR:
+		// ctr only understands fully qualified references
+		if insecure {
+			flags = append(flags, "--plain-http")
+		}
+		return append(append([]string{"images", action}, flags...), qualifyImage(image))
+	}
+	return append(append([]string{action}, flags...), image)
+}
+
+// qualifyImage return the fully qualified form of image, such as busybox => docker.io/library/busybox:latest
+func qualifyImage(image string) string {
+	host, repo, ref := splitRemoteImage(image)
+	if _, _, err := splitDigest(ref); err == nil {
+		return host + "/" + repo + "@" + ref
+	}
+	return host + "/" + repo + ":" + ref
+}
+
+// NewRuntime return the runtime of name, auto-detected if name is empty or "auto".
+// namespace is the containerd namespace of nerdctl and ctr, such as k8s.io
+func NewRuntime(name string, namespace string) (Runtime, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == RUNTIME_AUTO {
+		return DetectRuntime(namespace)
+	}
+	for _, known := range RUNTIME_DETECT_ORDER {
+		if name == known {
+			if _, err := FindBestBinary(name); err != nil {
+				return nil, fmt.Errorf("runtime %s: %s", name, err.Error())
+			}
+			return cliRuntime{name: name, namespace: namespace}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown runtime %s, must be one of %s", name, strings.Join(RUNTIME_DETECT_ORDER, ","))
+}
+
+// DetectRuntime return the first runtime of RUNTIME_DETECT_ORDER whose binary is found under os path
+func DetectRuntime(namespace string) (Runtime, error) {
+	for _, name := range RUNTIME_DETECT_ORDER {
+		if _, err := exec.LookPath(name); err == nil {
+			return cliRuntime{name: name, namespace: namespace}, nil
+		}
+	}
+	return nil, fmt.Errorf("no container runtime found, looked for %s", strings.Join(RUNTIME_DETECT_ORDER, ","))
+}
+
+// NewDefaultRuntime return the docker runtime
+func NewDefaultRuntime() Runtime {
+	return cliRuntime{name: DEFAULT_CRI_BINARY}
+}
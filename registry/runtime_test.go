@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"context"
+	"os"
+	paths "path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCliRuntime_RegistryArgs(t *testing.T) {
+	cases := []struct {
+		runtime cliRuntime
+		image   string
+		want    []string
+	}{
+		{cliRuntime{name: RUNTIME_DOCKER}, "127.0.0.1:5000/busybox", []string{"pull", "127.0.0.1:5000/busybox"}},
+		{cliRuntime{name: RUNTIME_PODMAN}, "127.0.0.1:5000/busybox", []string{"pull", "--tls-verify=false", "127.0.0.1:5000/busybox"}},
+		{cliRuntime{name: RUNTIME_PODMAN}, "nginx:1.25", []string{"pull", "nginx:1.25"}},
+		{cliRuntime{name: RUNTIME_NERDCTL}, "localhost:5000/busybox", []string{"pull", "--insecure-registry", "localhost:5000/busybox"}},
+		{cliRuntime{name: RUNTIME_CTR}, "nginx", []string{"images", "pull", "docker.io/library/nginx:latest"}},
+		{cliRuntime{name: RUNTIME_CTR}, "127.0.0.1:5000/app:v1", []string{"images", "pull", "--plain-http", "127.0.0.1:5000/app:v1"}},
+		{cliRuntime{name: RUNTIME_DOCKER, platform: "linux/arm64"}, "127.0.0.1:5000/busybox", []string{"pull", "--platform", "linux/arm64", "127.0.0.1:5000/busybox"}},
+		{cliRuntime{name: RUNTIME_CTR, platform: "linux/arm64"}, "127.0.0.1:5000/app:v1", []string{"images", "pull", "--platform", "linux/arm64", "--plain-http", "127.0.0.1:5000/app:v1"}},
+	}
+	for _, c := range cases {
+		if got := c.runtime.registryArgs("pull", c.image); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %s: got %v, want %v", c.runtime.name, c.image, got, c.want)
+		}
+	}
+}
+
+func TestNewRuntime_Unknown(t *testing.T) {
+	_, err := NewRuntime("rkt", "")
+	if err == nil {
+		t.Error("unknown runtime should be refused")
+	}
+}
+
+func TestCliRuntime_WithAuthFile(t *testing.T) {
+	dir := t.TempDir()
+	file := paths.Join(dir, "auth.json")
+	os.WriteFile(file, []byte(`{"auths":{}}`), 0600)
+
+	rt, release, err := cliRuntime{name: RUNTIME_PODMAN}.WithAuthFile(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	copied := rt.(cliRuntime).authDir
+	if _, err := os.Stat(paths.Join(copied, DOCKER_CONFIG_FILE_NAME)); err != nil {
+		t.Fatalf("the auth file should be copied as %s, got %s", DOCKER_CONFIG_FILE_NAME, err.Error())
+	}
+	release()
+	if _, err := os.Stat(copied); err == nil {
+		t.Error("the copy of the credentials should be removed once released")
+	}
+
+	// a config.json is used in place, release leaves it alone
+	file = paths.Join(dir, DOCKER_CONFIG_FILE_NAME)
+	os.WriteFile(file, []byte(`{"auths":{}}`), 0600)
+	rt, release, err = cliRuntime{name: RUNTIME_PODMAN}.WithAuthFile(file)
+	if err != nil || rt.(cliRuntime).authDir != dir {
+		t.Fatalf("the dir of config.json should be used, got %v", err)
+	}
+	release()
+	if _, err := os.Stat(file); err != nil {
+		t.Error("the auth file of the user should be kept")
+	}
+}
+
+func TestCliRuntime_Canceled(t *testing.T) {
+	// a runtime hanging on every command
+	dir := t.TempDir()
+	err := os.WriteFile(paths.Join(dir, "docker"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	rt := cliRuntime{name: RUNTIME_DOCKER}
+
+	calls := map[string]func(ctx context.Context) error{
+		"tag":     func(ctx context.Context) error { return rt.Tag(ctx, "app:v1", "app:v2") },
+		"untag":   func(ctx context.Context) error { return rt.Untag(ctx, "app:v1") },
+		"present": func(ctx context.Context) error { _, err := rt.CheckIfPresent(ctx, "app:v1"); return err },
+		"images":  func(ctx context.Context) error { _, err := rt.ListImages(ctx, nil); return err },
+		"ps":      func(ctx context.Context) error { _, err := rt.ListContainers(ctx, OWNER_LABEL); return err },
+		"port":    func(ctx context.Context) error { _, err := rt.PublishedPort(ctx, "run0000", 5000); return err },
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		if err == nil || time.Since(start) > 10*time.Second {
+			t.Errorf("%s should be killed once its context is done, got %v after %s", name, err, time.Since(start))
+		}
+	}
+}
+
+func TestParsePortOutput(t *testing.T) {
+	port, err := parsePortOutput("0.0.0.0:49153\n[::]:49153\n")
+	if err != nil || port != 49153 {
+		t.Errorf("got %d %v, want 49153", port, err)
+	}
+	port, err = parsePortOutput("[::1]:32768\n")
+	if err != nil || port != 32768 {
+		t.Errorf("got %d %v, want 32768", port, err)
+	}
+	if _, err := parsePortOutput(""); err == nil {
+		t.Error("an empty output should be refused")
+	}
+}
+
+func TestParseImageListOutput(t *testing.T) {
+	output := "myapp/web:2.3\nmyapp/worker:2.3\n<none>:<none>\nmyapp/web:<none>\nmyapp/web:2.3\n\n"
+	want := []string{"myapp/web:2.3", "myapp/worker:2.3"}
+	if got := parseImageListOutput(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,253 @@
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// this section matches tags against semantic version ranges, as npm and helm understand them:
+//
+//	~1.4          >=1.4.0 <1.5.0
+//	^1.4          >=1.4.0 <2.0.0
+//	1.4.x, 1.4    >=1.4.0 <1.5.0
+//	>=1.4 <2      both comparators must hold
+//	1.x || 2.x    either range holds
+//
+// a tag with a prerelease, such as 1.5.0-rc.1, only matches a range naming a prerelease of the same version
+
+// Version is a semantic version parsed from a tag, such as v1.4.2 or 1.4
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+type versionComparator struct {
+	op      string
+	version Version
+}
+
+// VersionRange is a parsed range, its comparator sets are or-ed, the comparators of a set and-ed
+type VersionRange [][]versionComparator
+
+// ParseVersion parse a tag as a version, a leading v and missing minor or patch are allowed.
+// build metadata is ignored. return false if the tag is not a version
+func ParseVersion(tag string) (Version, bool) {
+	v, n, err := parsePartialVersion(tag)
+	if err != nil || n < 0 {
+		return Version{}, false
+	}
+	return v, true
+}
+
+// parsePartialVersion parse a version whose trailing components may be missing or wildcards,
+// return the number of the components given, -1 if they are all wildcards
+func parsePartialVersion(s string) (Version, int, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	v := Version{}
+	if i := strings.Index(s, "-"); i >= 0 {
+		s, v.Prerelease = s[:i], s[i+1:]
+		if v.Prerelease == "" {
+			return v, 0, fmt.Errorf("malformed version %s", s)
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("malformed version %s", s)
+	}
+	n, wildcard := 0, false
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			wildcard = true
+			continue
+		}
+		if wildcard {
+			// the components past a wildcard must be wildcards too
+			return v, 0, fmt.Errorf("malformed version %s", s)
+		}
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || part != strconv.Itoa(number) {
+			return v, 0, fmt.Errorf("malformed version %s", s)
+		}
+		switch i {
+		case 0:
+			v.Major = number
+		case 1:
+			v.Minor = number
+		case 2:
+			v.Patch = number
+		}
+		n++
+	}
+	if n == 0 {
+		n = -1
+	}
+	if v.Prerelease != "" && n != 3 {
+		return v, 0, fmt.Errorf("malformed version %s, a prerelease needs a full version", s)
+	}
+	return v, n, nil
+}
+
+// Compare return -1, 0 or 1 if v is older, the same or newer than o
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+	a, b := strings.Split(v.Prerelease, "."), strings.Split(o.Prerelease, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errA := strconv.Atoi(a[i])
+		y, errB := strconv.Atoi(b[i])
+		switch {
+		case errA == nil && errB == nil && x < y, errA == nil && errB != nil, errA != nil && errB != nil && a[i] < b[i]:
+			return -1
+		}
+		return 1
+	}
+	if len(a) < len(b) {
+		return -1
+	}
+	if len(a) > len(b) {
+		return 1
+	}
+	return 0
+}
+
+// ParseVersionRange parse a range such as ~1.4, ^1.4, >=1.4 <2 or 1.x || 2.x
+func ParseVersionRange(s string) (VersionRange, error) {
+	ret := VersionRange{}
+	for _, set := range strings.Split(s, "||") {
+		comparators := make([]versionComparator, 0)
+		for _, term := range strings.Fields(set) {
+			c, err := parseVersionTerm(term)
+			if err != nil {
+				return nil, fmt.Errorf("version range %s: %s", s, err.Error())
+			}
+			comparators = append(comparators, c...)
+		}
+		ret = append(ret, comparators)
+	}
+	return ret, nil
+}
+
+// parseVersionTerm parse a term of a range into the comparators it stands for
+func parseVersionTerm(term string) ([]versionComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(term, prefix) {
+			op, term = prefix, term[len(prefix):]
+			break
+		}
+	}
+	v, n, err := parsePartialVersion(term)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		// a wildcard matches any version, unless it's compared
+		if op == "<" || op == ">" {
+			return []versionComparator{{op: "<", version: Version{}}}, nil
+		}
+		return nil, nil
+	}
+	// next return the first version past the components given
+	next := func(components int) Version {
+		switch components {
+		case 1:
+			return Version{Major: v.Major + 1}
+		case 2:
+			return Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	switch op {
+	case ">=", "<":
+		return []versionComparator{{op: op, version: v}}, nil
+	case ">":
+		if n == 3 {
+			return []versionComparator{{op: ">", version: v}}, nil
+		}
+		return []versionComparator{{op: ">=", version: next(n)}}, nil
+	case "<=":
+		if n == 3 {
+			return []versionComparator{{op: "<=", version: v}}, nil
+		}
+		return []versionComparator{{op: "<", version: next(n)}}, nil
+	case "~":
+		if n == 3 {
+			n = 2
+		}
+		return []versionComparator{{op: ">=", version: v}, {op: "<", version: next(n)}}, nil
+	case "^":
+		// the first non-zero component given is kept
+		keep := n
+		switch {
+		case v.Major != 0 || n == 1:
+			keep = 1
+		case v.Minor != 0 || n == 2:
+			keep = 2
+		}
+		return []versionComparator{{op: ">=", version: v}, {op: "<", version: next(keep)}}, nil
+	}
+	if n == 3 {
+		return []versionComparator{{op: "=", version: v}}, nil
+	}
+	return []versionComparator{{op: ">=", version: v}, {op: "<", version: next(n)}}, nil
+}
+
+// Contains return true if v is in the range
+func (r VersionRange) Contains(v Version) bool {
+	for _, set := range r {
+		if versionSetContains(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func versionSetContains(set []versionComparator, v Version) bool {
+	prerelease := v.Prerelease == ""
+	for _, c := range set {
+		d := v.Compare(c.version)
+		ok := false
+		switch c.op {
+		case ">=":
+			ok = d >= 0
+		case ">":
+			ok = d > 0
+		case "<=":
+			ok = d <= 0
+		case "<":
+			ok = d < 0
+		case "=":
+			ok = d == 0
+		}
+		if !ok {
+			return false
+		}
+		if c.version.Prerelease != "" && c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+			prerelease = true
+		}
+	}
+	return prerelease
+}
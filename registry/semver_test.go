@@ -0,0 +1,42 @@
+package registry
+
+import "testing"
+
+func TestVersionRange_Contains(t *testing.T) {
+	cases := []struct {
+		r   string
+		in  []string
+		out []string
+	}{
+		{"~1.4", []string{"1.4", "v1.4.0", "1.4.9"}, []string{"1.5.0", "1.3.9", "1.4.1-rc.1", "latest"}},
+		{"^1.4", []string{"1.4.0", "1.9.3", "v1.5+build.7"}, []string{"2.0.0", "1.3.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{">=1.4 <2", []string{"1.4.0", "1.99.0"}, []string{"2.0.0", "1.3.99"}},
+		{"1.x || >2.1", []string{"1.0.0", "1.9.9", "2.2.0"}, []string{"2.0.0", "2.1.5"}},
+		{"<=1.4", []string{"1.4.9", "0.1.0"}, []string{"1.5.0"}},
+		{">=1.5.0-rc.1", []string{"1.5.0-rc.2", "1.5.0", "1.6.0"}, []string{"1.5.0-beta", "1.6.0-rc.1"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-rc.1"}},
+	}
+	for _, c := range cases {
+		r, err := ParseVersionRange(c.r)
+		if err != nil {
+			t.Errorf("%s: %s", c.r, err.Error())
+			continue
+		}
+		for _, tag := range c.in {
+			if v, ok := ParseVersion(tag); !ok || !r.Contains(v) {
+				t.Errorf("%s should contain %s", c.r, tag)
+			}
+		}
+		for _, tag := range c.out {
+			if v, ok := ParseVersion(tag); ok && r.Contains(v) {
+				t.Errorf("%s should not contain %s", c.r, tag)
+			}
+		}
+	}
+	for _, r := range []string{">=1.4.a", "~1.2.3.4", "^"} {
+		if _, err := ParseVersionRange(r); err == nil {
+			t.Errorf("%s should be refused", r)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// this section implements a read-only Registry HTTP API v2 serving a registry:2 data dir,
+// which replaces the registry:2 container on the load side
+
+// Server serves the images of a data dir, it's started on an ephemeral loopback port
+type Server struct {
+	storage *Storage
+
+	listener net.Listener
+
+	server *http.Server
+}
+
+// NewServer return a server of the registry data dir dataPath
+func NewServer(dataPath string) *Server {
+	return &Server{storage: NewStorage(dataPath)}
+}
+
+// Start listen on an ephemeral port of the loopback interface and serve in background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s}
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("registry server stopped: %s \n", err.Error())
+		}
+	}()
+	log.Printf("serving registry data on %s \n", s.Addr())
+	return nil
+}
+
+// Addr return the host:port the server listens on, such as 127.0.0.1:39017
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Stop the server, waiting for in-flight requests at most 10 seconds
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	s.server = nil
+	s.listener = nil
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+	path := req.URL.Path
+	switch {
+	case path == "/v2/" || path == "/v2":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+	case path == "/v2/_catalog":
+		s.serveCatalog(w)
+	case strings.HasSuffix(path, "/tags/list"):
+		s.serveTags(w, strings.TrimSuffix(strings.TrimPrefix(path, "/v2/"), "/tags/list"))
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		s.serveManifest(w, req, strings.TrimPrefix(path[:i], "/v2/"), path[i+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		s.serveBlob(w, req, strings.TrimPrefix(path[:i], "/v2/"), path[i+len("/blobs/"):])
+	default:
+		writeRegistryError(w, http.StatusNotFound, "NOT_FOUND", "unknown endpoint")
+	}
+}
+
+func (s *Server) serveCatalog(w http.ResponseWriter) {
+	repos, err := s.storage.Repositories()
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	writeJSON(w, map[string][]string{"repositories": repos})
+}
+
+func (s *Server) serveTags(w http.ResponseWriter, repo string) {
+	tags, err := s.storage.Tags(repo)
+	if err != nil {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+		return
+	}
+	writeJSON(w, map[string]interface{}{"name": repo, "tags": tags})
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, req *http.Request, repo string, ref string) {
+	digest := ref
+	if strings.HasPrefix(ref, "sha256:") {
+		if !s.storage.HasManifest(repo, digest) {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+	} else {
+		var err error
+		digest, err = s.storage.ResolveTag(repo, ref)
+		if err != nil {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+	}
+	body, err := s.storage.ReadBlob(digest)
+	if err != nil {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	m, err := ParseManifest(body, "")
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = MEDIA_TYPE_OCI_MANIFEST
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, req *http.Request, repo string, digest string) {
+	if !s.storage.HasLinkedBlob(repo, digest) && !s.storage.HasManifest(repo, digest) {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	file, err := s.storage.OpenBlob(digest)
+	if err != nil {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Etag", `"`+digest+`"`)
+	// ServeContent handles HEAD and range requests
+	http.ServeContent(w, req, "", time.Time{}, file)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeRegistryError answer with the error format of the distribution spec
+func writeRegistryError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	dataPath := t.TempDir()
+	storage := NewStorage(dataPath)
+	layer := []byte("layer content")
+	config := []byte(`{"os":"linux"}`)
+	for _, blob := range [][]byte{layer, config} {
+		if err := storage.WriteBlob(Digest(blob), bytes.NewReader(blob)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := storage.LinkBlob("cicd/app", Digest(blob)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	body, _ := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MEDIA_TYPE_DOCKER_MANIFEST,
+		Config:        &Descriptor{Digest: Digest(config), Size: int64(len(config))},
+		Layers:        []Descriptor{{Digest: Digest(layer), Size: int64(len(layer))}},
+	})
+	if err := storage.PutManifest("cicd/app", Digest(body), body); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := storage.Tag("cicd/app", "v1", Digest(body)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	server := NewServer(dataPath)
+	if err := server.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Stop()
+
+	ctx := context.Background()
+	client := NewDefaultClient()
+	got, mediaType, digest, err := client.GetManifest(ctx, server.Addr(), "cicd/app", "v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != string(body) || mediaType != MEDIA_TYPE_DOCKER_MANIFEST || digest != Digest(body) {
+		t.Errorf("unexpected manifest %s %s", mediaType, digest)
+	}
+
+	reader, _, err := client.GetBlob(ctx, server.Addr(), "cicd/app", Digest(layer))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != string(layer) {
+		t.Errorf("unexpected blob content %q", content)
+	}
+
+	// blobs are only served from the repositories they are linked into
+	_, _, err = client.GetBlob(ctx, server.Addr(), "other", Digest(layer))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %v", err)
+	}
+
+	resp, err := http.Get("http://" + server.Addr() + "/v2/_catalog")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var catalog map[string][]string
+	json.NewDecoder(resp.Body).Decode(&catalog)
+	resp.Body.Close()
+	if len(catalog["repositories"]) != 1 || catalog["repositories"][0] != "cicd/app" {
+		t.Errorf("unexpected catalog %v", catalog)
+	}
+
+	resp, err = http.Post("http://"+server.Addr()+"/v2/cicd/app/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("uploads should be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestRebaseImage(t *testing.T) {
+	if got := RebaseImage("localhost:5000/busybox:v1", "127.0.0.1:39017"); got != "127.0.0.1:39017/busybox:v1" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,271 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	paths "path"
+	"sort"
+	"strings"
+)
+
+// Storage writes images into the filesystem layout of the registry:2 storage driver,
+// so the data dir can be served by a registry instance as if the images were pushed into it
+//   - blobs/sha256/<2 hex>/<hex>/data: content of every layer, config and manifest
+//   - repositories/<name>/_layers/sha256/<hex>/link: blobs linked into a repository
+//   - repositories/<name>/_manifests/revisions/sha256/<hex>/link: manifests of a repository
+//   - repositories/<name>/_manifests/tags/<tag>/{current,index/sha256/<hex>}/link: tags of a repository
+type Storage struct {
+	// root is <DataPath>/docker/registry/v2
+	root string
+}
+
+// REGISTRY_STORAGE_ROOT is the storage root relative to the registry data dir
+var REGISTRY_STORAGE_ROOT = "docker/registry/v2"
+
+// NewStorage return the storage of the registry data dir
+func NewStorage(dataPath string) *Storage {
+	return &Storage{root: paths.Join(dataPath, REGISTRY_STORAGE_ROOT)}
+}
+
+// HasBlob return true if the blob content is present
+func (s *Storage) HasBlob(digest string) bool {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// WriteBlob write the content of r as blob digest. the content is verified
+// against the digest before it's moved into place
+func (s *Storage) WriteBlob(digest string, r io.Reader) error {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	return writeVerified(path, digest, r)
+}
+
+// writeVerified write the content of r into path through a temp file,
+// which is renamed into place once the content matches the digest
+func writeVerified(path string, digest string, r io.Reader) error {
+	err := os.MkdirAll(paths.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(paths.Dir(path), "data-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	actual := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	if actual != digest {
+		return fmt.Errorf("blob %s: digest mismatch, got %s", digest, actual)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LinkBlob link an existing blob into repo
+func (s *Storage) LinkBlob(repo string, digest string) error {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return err
+	}
+	return s.writeLink(paths.Join(s.root, "repositories", repo, "_layers", "sha256", encoded, "link"), digest)
+}
+
+// PutManifest store the manifest body as a revision of repo
+func (s *Storage) PutManifest(repo string, digest string, body []byte) error {
+	if !s.HasBlob(digest) {
+		err := s.WriteBlob(digest, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+	}
+	return s.LinkManifest(repo, digest)
+}
+
+// LinkManifest make the manifest digest a revision of repo, its content may be absent
+func (s *Storage) LinkManifest(repo string, digest string) error {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return err
+	}
+	return s.writeLink(paths.Join(s.root, "repositories", repo, "_manifests", "revisions", "sha256", encoded, "link"), digest)
+}
+
+// Tag point the tag of repo to the manifest digest
+func (s *Storage) Tag(repo string, tag string, digest string) error {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return err
+	}
+	tagDir := paths.Join(s.root, "repositories", repo, "_manifests", "tags", tag)
+	err = s.writeLink(paths.Join(tagDir, "index", "sha256", encoded, "link"), digest)
+	if err != nil {
+		return err
+	}
+	return s.writeLink(paths.Join(tagDir, "current", "link"), digest)
+}
+
+func (s *Storage) writeLink(path string, digest string) error {
+	err := os.MkdirAll(paths.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(digest), 0644)
+}
+
+func (s *Storage) blobPath(digest string) (string, error) {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	return paths.Join(s.root, "blobs", "sha256", encoded[:2], encoded, "data"), nil
+}
+
+// ResolveTag return the manifest digest the tag of repo points to
+func (s *Storage) ResolveTag(repo string, tag string) (string, error) {
+	return s.readLink(paths.Join(s.root, "repositories", repo, "_manifests", "tags", tag, "current", "link"))
+}
+
+// HasManifest return true if the manifest digest is a revision of repo
+func (s *Storage) HasManifest(repo string, digest string) bool {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return false
+	}
+	_, err = s.readLink(paths.Join(s.root, "repositories", repo, "_manifests", "revisions", "sha256", encoded, "link"))
+	return err == nil
+}
+
+// Platforms return the platforms whose manifests are present in repo if tag points to a manifest list,
+// nil if tag points to the manifest of a single platform
+func (s *Storage) Platforms(repo string, tag string) ([]Platform, error) {
+	digest, err := s.ResolveTag(repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.ReadBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseManifest(body, "")
+	if err != nil {
+		return nil, err
+	}
+	if !IsIndexMediaType(m.MediaType) {
+		return nil, nil
+	}
+	ret := make([]Platform, 0)
+	for _, desc := range m.Manifests {
+		if desc.Platform != nil && s.HasManifest(repo, desc.Digest) && s.HasBlob(desc.Digest) {
+			ret = append(ret, *desc.Platform)
+		}
+	}
+	return ret, nil
+}
+
+// HasLinkedBlob return true if the blob is linked into repo and its content is present
+func (s *Storage) HasLinkedBlob(repo string, digest string) bool {
+	_, encoded, err := splitDigest(digest)
+	if err != nil {
+		return false
+	}
+	_, err = s.readLink(paths.Join(s.root, "repositories", repo, "_layers", "sha256", encoded, "link"))
+	return err == nil && s.HasBlob(digest)
+}
+
+// OpenBlob open the content of the blob, the caller must close it
+func (s *Storage) OpenBlob(digest string) (*os.File, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// ReadBlob return the whole content of a small blob such as a manifest
+func (s *Storage) ReadBlob(digest string) ([]byte, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Repositories list the name of every repository holding manifests
+func (s *Storage) Repositories() ([]string, error) {
+	ret := make([]string, 0)
+	base := paths.Join(s.root, "repositories")
+	var walk func(dir string, name string) error
+	walk = func(dir string, name string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			if entry.Name() == "_manifests" {
+				ret = append(ret, name)
+				continue
+			}
+			if strings.HasPrefix(entry.Name(), "_") {
+				continue
+			}
+			err = walk(paths.Join(dir, entry.Name()), strings.TrimPrefix(name+"/"+entry.Name(), "/"))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(base, "")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Tags list the tags of repo
+func (s *Storage) Tags(repo string) ([]string, error) {
+	entries, err := os.ReadDir(paths.Join(s.root, "repositories", repo, "_manifests", "tags"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ret = append(ret, entry.Name())
+		}
+	}
+	return ret, nil
+}
+
+func (s *Storage) readLink(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(content))
+	if _, _, err := splitDigest(digest); err != nil {
+		return "", fmt.Errorf("link %s: %s", path, err.Error())
+	}
+	return digest, nil
+}
@@ -0,0 +1,59 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VerifyReport is the result of verifying an archive
+type VerifyReport struct {
+	// Format of the archive
+	Format string
+
+	// Blobs is the number of blobs whose content matches their digest
+	Blobs int
+
+	// Base is the number of blobs left out as the base archive carries them
+	Base int
+
+	// Corrupted are the blobs whose content doesn't match their digest
+	Corrupted []string
+
+	// Images of the archive, with the problems found resolving them
+	Images []*ArchiveImage
+}
+
+// OK return true if every blob is intact and every image resolves to blobs present
+func (r *VerifyReport) OK() bool {
+	if len(r.Corrupted) != 0 || len(r.Images) == 0 {
+		return false
+	}
+	for _, image := range r.Images {
+		if len(image.Problems) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyArchive stream the archive at path, checking the sha256 of every blob against its digest
+// and that every image of its image list resolves to blobs which are present. nothing is extracted
+func VerifyArchive(path string) (*VerifyReport, error) {
+	contents, err := ScanArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{
+		Format: contents.Format,
+		Blobs:  len(contents.Blobs),
+		Images: contents.Images(),
+	}
+	if contents.Delta != nil {
+		report.Base = len(contents.Delta.Blobs)
+	}
+	for digest, reason := range contents.Corrupted {
+		report.Corrupted = append(report.Corrupted, fmt.Sprintf("%s: %s", digest, reason))
+	}
+	sort.Strings(report.Corrupted)
+	return report, nil
+}
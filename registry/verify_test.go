@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	paths "path"
+	"strings"
+	"testing"
+)
+
+// dumpFakeArchive fetch the images of remote into a registry layout archive, return the dir
+// of the extracted data and the archive path
+func dumpFakeArchive(t *testing.T, images map[string]string, platforms string) (string, string) {
+	dir := t.TempDir()
+	fetcher := NewDefaultNativeFetcher(paths.Join(dir, "data"))
+	fetcher.Platforms, _ = ParsePlatforms(platforms)
+	err := fetcher.FetchAll(context.Background(), images)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = PersistentToFile(images, paths.Join(dir, "images.json"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	archive := paths.Join(t.TempDir(), "dump.tar.gz")
+	err = TarCompressDirTo(context.Background(), archive, dir, "data", "images.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return dir, archive
+}
+
+func TestVerifyArchive(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	amd64, _ := remote.addImage("", "amd64 layer", &Platform{OS: "linux", Architecture: "amd64"})
+	arm64, _ := remote.addImage("", "arm64 layer", &Platform{OS: "linux", Architecture: "arm64"})
+	list := remote.addIndex("v1", amd64, arm64)
+	single, _ := remote.addImage("v2", "single layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	images := map[string]string{
+		host + "/cicd/app:v1": "localhost:5000/app:v1",
+		host + "/cicd/app:v2": "localhost:5000/app:v2",
+	}
+	dir, archive := dumpFakeArchive(t, images, "linux/arm64")
+	report, err := VerifyArchive(archive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !report.OK() {
+		t.Fatalf("archive should pass verification, got %+v", report.Images)
+	}
+	if len(report.Images) != 2 || report.Images[0].Digest != list || report.Images[1].Digest != single.Digest {
+		t.Fatalf("unexpected images %+v", report.Images)
+	}
+	if p := report.Images[0].Platforms; len(p) != 1 || p[0].Architecture != "arm64" {
+		t.Errorf("the sparse list should resolve to arm64 only, got %v", p)
+	}
+
+	// flip the content of a layer
+	layer, _ := NewStorage(paths.Join(dir, "data")).blobPath(Digest([]byte("arm64 layer")))
+	err = os.WriteFile(layer, []byte("arm64 layex"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// and drop the manifest of v2
+	manifest, _ := NewStorage(paths.Join(dir, "data")).blobPath(single.Digest)
+	os.Remove(manifest)
+	err = TarCompressDirTo(context.Background(), archive, dir, "data", "images.json")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err = VerifyArchive(archive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.OK() || len(report.Corrupted) != 1 {
+		t.Fatalf("the corrupted layer should be reported, got %v", report.Corrupted)
+	}
+	if problems := report.Images[0].Problems; len(problems) != 1 || !strings.Contains(problems[0], "corrupted") {
+		t.Errorf("unexpected problems of v1: %v", problems)
+	}
+	if problems := report.Images[1].Problems; len(problems) != 1 || !strings.Contains(problems[0], "missing") {
+		t.Errorf("unexpected problems of v2: %v", problems)
+	}
+}
+
+func TestVerifyArchive_OCI(t *testing.T) {
+	remote := newFakeRemote("cicd/app")
+	desc, _ := remote.addImage("v1", "layer", nil)
+	server := httptest.NewServer(remote)
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/cicd/app:v1"
+
+	root := t.TempDir()
+	layout := NewOCILayout(root)
+	fetcher := NewDefaultNativeFetcher("")
+	fetcher.Storage = layout
+	err := fetcher.FetchAll(context.Background(), map[string]string{image: "localhost:5000/app:v1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = layout.WriteIndex()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	archive := paths.Join(t.TempDir(), "oci.tar.gz")
+	err = TarCompressDirTo(context.Background(), archive, root, "oci-layout", "index.json", "blobs")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := VerifyArchive(archive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !report.OK() || report.Format != FORMAT_OCI {
+		t.Fatalf("archive should pass verification, got %+v", report)
+	}
+	if report.Images[0].Reference != image || report.Images[0].Digest != desc.Digest {
+		t.Errorf("unexpected image %+v", report.Images[0])
+	}
+}